@@ -0,0 +1,489 @@
+package dyndns_handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"github.com/google/uuid"
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ACMEDNSHandler implements the register and update api of acme-dns, see
+// https://github.com/joohoi/acme-dns, so ACME clients that support acme-dns
+// can get certificates with the DNS-01 challenge. Every registration gets
+// its own subdomain of Domain, to which the _acme-challenge record of the
+// hostname should be delegated with a CNAME. The TXT records are written
+// with the DNS providers and the registrations are kept in the storage.
+type ACMEDNSHandler struct {
+
+	// The domain under which the subdomains of the registrations
+	// are created, like acme.example.com
+	Domain string `json:"domain"`
+
+	// The provider configurations with which the
+	// TXT records of the subdomains will be set.
+	ProvidersRaw []json.RawMessage `json:"providers,omitempty" caddy:"namespace=dns.providers inline_key=name"`
+
+	// The networks from which new registrations are allowed. When
+	// empty, only requests that are authenticated before this handler
+	// (like with basic_auth) can register, see OpenRegistration.
+	RegisterFrom *IPPrefixList `json:"register_from,omitempty"`
+
+	// When true and no networks are configured, everyone
+	// can register, like the default of acme-dns.
+	OpenRegistration bool `json:"open_registration,omitempty"`
+
+	// The TTL of the TXT records. Default: 1m
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// The storage prefix of the registrations. Default: ddns/acme_dns
+	StoragePrefix string `json:"storage_prefix,omitempty"`
+
+	providers []Provider
+	zones     *zoneCache
+	storage   certmagic.Storage
+	logger    *zap.Logger
+	fakeHash  []byte
+	mu        *sync.Mutex
+}
+
+// acmeDNSRegistration is a registration as kept in the storage.
+type acmeDNSRegistration struct {
+	Username  string   `json:"username"`
+	Password  []byte   `json:"password"` // bcrypt hash
+	Subdomain string   `json:"subdomain"`
+	AllowFrom []string `json:"allowfrom,omitempty"`
+	TXT       []string `json:"txt,omitempty"`
+}
+
+func init() {
+	httpcaddyfile.RegisterHandlerDirective("acme_dns", parseACMEDNSCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("acme_dns", "after", "route")
+	caddy.RegisterModule(ACMEDNSHandler{})
+}
+
+func (ACMEDNSHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.acme_dns",
+		New: func() caddy.Module { return new(ACMEDNSHandler) },
+	}
+}
+
+func (a *ACMEDNSHandler) Provision(ctx caddy.Context) error {
+
+	if a.Domain == "" {
+		return fmt.Errorf("no domain defined")
+	}
+
+	if len(a.ProvidersRaw) == 0 {
+		return fmt.Errorf("no DNS providers defined")
+	}
+
+	providers, err := loadProviders(ctx, a, "ProvidersRaw")
+
+	if err != nil {
+		return err
+	}
+
+	if a.TTL <= 0 {
+		a.TTL = caddy.Duration(time.Minute)
+	}
+
+	if a.StoragePrefix == "" {
+		a.StoragePrefix = "ddns/acme_dns"
+	}
+
+	fake, err := bcrypt.GenerateFromPassword([]byte("fake password"), bcrypt.DefaultCost)
+
+	if err != nil {
+		return err
+	}
+
+	a.Domain = normalizeName(a.Domain)
+	a.providers = providers
+	a.logger = ctx.Logger()
+	a.zones = newZoneCache(ctx, providers, 0, a.logger)
+	a.storage = ctx.Storage()
+	a.fakeHash = fake
+	a.mu = new(sync.Mutex)
+
+	return nil
+}
+
+// ServeHTTP handles the register, update and health endpoints, where
+// other requests are passed to the next handler.
+func (a *ACMEDNSHandler) ServeHTTP(response http.ResponseWriter, request *http.Request, next caddyhttp.Handler) error {
+
+	switch {
+	case request.Method == http.MethodPost && strings.HasSuffix(request.URL.Path, "/register"):
+		return a.register(response, request)
+	case request.Method == http.MethodPost && strings.HasSuffix(request.URL.Path, "/update"):
+		return a.update(response, request)
+	case request.Method == http.MethodGet && strings.HasSuffix(request.URL.Path, "/health"):
+		response.WriteHeader(http.StatusOK)
+		return nil
+	default:
+		return next.ServeHTTP(response, request)
+	}
+}
+
+// register creates a new registration, with an optional list of networks
+// (allowfrom) from which the registration can be updated.
+func (a *ACMEDNSHandler) register(response http.ResponseWriter, request *http.Request) error {
+
+	if false == a.allowsRegister(request) {
+		a.logger.Warn("registration not allowed", zap.String("remote", clientIP(request)))
+		return writeACMEDNSError(response, http.StatusUnauthorized, "forbidden")
+	}
+
+	var body struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+
+	if data, err := io.ReadAll(io.LimitReader(request.Body, 1<<16)); err != nil {
+		return err
+	} else if len(data) > 0 {
+		if err := json.Unmarshal(data, &body); err != nil {
+			return writeACMEDNSError(response, http.StatusBadRequest, "malformed_json_payload")
+		}
+	}
+
+	for _, value := range body.AllowFrom {
+		if _, err := netip.ParsePrefix(value); err != nil {
+			return writeACMEDNSError(response, http.StatusBadRequest, "invalid_allowfrom_cidr")
+		}
+	}
+
+	var secret = make([]byte, 30)
+
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	var password = base64.RawURLEncoding.EncodeToString(secret)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return err
+	}
+
+	var registration = &acmeDNSRegistration{
+		Username:  uuid.NewString(),
+		Password:  hash,
+		Subdomain: uuid.NewString(),
+		AllowFrom: body.AllowFrom,
+	}
+
+	if err := a.store(request.Context(), registration); err != nil {
+		a.logger.Error("could not store registration", zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	a.logger.Info("new registration", zap.String("subdomain", registration.Subdomain), zap.String("remote", clientIP(request)))
+
+	return writeACMEDNSResponse(response, http.StatusCreated, map[string]any{
+		"username":   registration.Username,
+		"password":   password,
+		"fulldomain": registration.Subdomain + "." + a.Domain,
+		"subdomain":  registration.Subdomain,
+		"allowfrom":  append(make([]string, 0), body.AllowFrom...),
+	})
+}
+
+// allowsRegister checks if the client is within the register_from networks,
+// or when not configured, if the request is authenticated by a handler
+// before this one (which sets the http.auth.user.id placeholder) or
+// open registration is enabled.
+func (a *ACMEDNSHandler) allowsRegister(request *http.Request) bool {
+
+	if nil != a.RegisterFrom {
+		ip, err := netip.ParseAddr(clientIP(request))
+		return err == nil && a.RegisterFrom.Contains(ip.Unmap())
+	}
+
+	if a.OpenRegistration {
+		return true
+	}
+
+	if repl, ok := request.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		if id, ok := repl.GetString("http.auth.user.id"); ok && id != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// update sets the TXT record of the subdomain of the registration, where
+// the last two values are kept so a domain and its wildcard can be
+// validated at the same time.
+func (a *ACMEDNSHandler) update(response http.ResponseWriter, request *http.Request) error {
+
+	var registration, ok = a.authenticate(request)
+
+	if false == ok {
+		return writeACMEDNSError(response, http.StatusUnauthorized, "forbidden")
+	}
+
+	var body struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(request.Body, 1<<16)).Decode(&body); err != nil {
+		return writeACMEDNSError(response, http.StatusBadRequest, "malformed_json_payload")
+	}
+
+	if body.Subdomain != registration.Subdomain {
+		return writeACMEDNSError(response, http.StatusUnauthorized, "forbidden")
+	}
+
+	// the challenge value is a base64url encoded sha256 sum
+	if len(body.TXT) != 43 {
+		return writeACMEDNSError(response, http.StatusBadRequest, "bad_txt")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// reload, as another request could have updated it
+	registration, err := a.load(request.Context(), registration.Username)
+
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	registration.TXT = append([]string{body.TXT}, registration.TXT...)
+
+	if len(registration.TXT) > 2 {
+		registration.TXT = registration.TXT[:2]
+	}
+
+	if err := a.setRecords(request.Context(), registration); err != nil {
+		a.logger.Error("could not set records", zap.String("subdomain", registration.Subdomain), zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	if err := a.store(request.Context(), registration); err != nil {
+		a.logger.Error("could not store registration", zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	a.logger.Info("updated txt record", zap.String("subdomain", registration.Subdomain))
+
+	return writeACMEDNSResponse(response, http.StatusOK, map[string]string{"txt": body.TXT})
+}
+
+// authenticate checks the X-Api-User and X-Api-Key headers and the allowed
+// networks of the registration. When the user does not exist, a fake hash
+// is compared, so the timing does not reveal if it exists.
+func (a *ACMEDNSHandler) authenticate(request *http.Request) (*acmeDNSRegistration, bool) {
+
+	var username = request.Header.Get("X-Api-User")
+	var password = request.Header.Get("X-Api-Key")
+	var hash = a.fakeHash
+
+	registration, err := a.load(request.Context(), username)
+
+	if err == nil {
+		hash = registration.Password
+	} else if false == errors.Is(err, fs.ErrNotExist) {
+		a.logger.Error("could not load registration", zap.Error(err))
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || nil == registration {
+		return nil, false
+	}
+
+	if len(registration.AllowFrom) == 0 {
+		return registration, true
+	}
+
+	ip, err := netip.ParseAddr(clientIP(request))
+
+	if err != nil {
+		return nil, false
+	}
+
+	for _, value := range registration.AllowFrom {
+		if prefix, err := netip.ParsePrefix(value); err == nil && prefix.Contains(ip.Unmap()) {
+			return registration, true
+		}
+	}
+
+	return nil, false
+}
+
+func (a *ACMEDNSHandler) setRecords(ctx context.Context, registration *acmeDNSRegistration) error {
+
+	var name = registration.Subdomain + "." + a.Domain
+	var idx, zone, ok = findZone(name, a.zones.Get(ctx))
+
+	if false == ok {
+		return fmt.Errorf("%s not supported by providers", name)
+	}
+
+	var records = make([]libdns.Record, len(registration.TXT))
+
+	for i, value := range registration.TXT {
+		records[i] = libdns.TXT{
+			Name: libdns.RelativeName(name, normalizeName(zone)),
+			TTL:  time.Duration(a.TTL),
+			Text: value,
+		}
+	}
+
+	_, err := a.providers[idx].SetRecords(ctx, zone, records)
+
+	return err
+}
+
+func (a *ACMEDNSHandler) load(ctx context.Context, username string) (*acmeDNSRegistration, error) {
+
+	if err := uuid.Validate(username); err != nil {
+		return nil, fs.ErrNotExist
+	}
+
+	data, err := a.storage.Load(ctx, path.Join(a.StoragePrefix, strings.ToLower(username)+".json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var registration = new(acmeDNSRegistration)
+
+	if err := json.Unmarshal(data, registration); err != nil {
+		return nil, err
+	}
+
+	return registration, nil
+}
+
+func (a *ACMEDNSHandler) store(ctx context.Context, registration *acmeDNSRegistration) error {
+
+	data, err := json.Marshal(registration)
+
+	if err != nil {
+		return err
+	}
+
+	return a.storage.Store(ctx, path.Join(a.StoragePrefix, registration.Username+".json"), data)
+}
+
+func writeACMEDNSResponse(response http.ResponseWriter, status int, value any) error {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	return json.NewEncoder(response).Encode(value)
+}
+
+func writeACMEDNSError(response http.ResponseWriter, status int, message string) error {
+	return writeACMEDNSResponse(response, status, map[string]string{"error": message})
+}
+
+func parseACMEDNSCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler = new(ACMEDNSHandler)
+
+	if err := handler.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	acme_dns [<matcher>] {
+//		domain <domain>
+//		providers {
+//			<name> ...
+//		}
+//		register_from <ip prefix>...
+//		open_registration
+//		ttl <duration>
+//		storage_prefix <prefix>
+//	}
+func (a *ACMEDNSHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.Next() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "domain":
+			if !d.AllArgs(&a.Domain) {
+				return d.ArgErr()
+			}
+		case "providers":
+			providers, err := unmarshalProviders(d)
+
+			if err != nil {
+				return err
+			}
+
+			a.ProvidersRaw = providers
+		case "register_from":
+			var args = d.RemainingArgs()
+			if len(args) == 0 {
+				return d.Errf("must specify at least one ip prefix")
+			}
+			a.RegisterFrom = new(IPPrefixList)
+			for _, arg := range args {
+				prefix, err := netip.ParsePrefix(arg)
+				if err != nil {
+					return d.Errf("invalid ip prefix: %v", err)
+				}
+				*a.RegisterFrom = append(*a.RegisterFrom, prefix)
+			}
+		case "open_registration":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			a.OpenRegistration = true
+		case "ttl":
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid ttl: %v", err)
+			}
+			a.TTL = caddy.Duration(ttl)
+		case "storage_prefix":
+			if !d.AllArgs(&a.StoragePrefix) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized acme_dns option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ caddy.Provisioner           = (*ACMEDNSHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*ACMEDNSHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*ACMEDNSHandler)(nil)
+)
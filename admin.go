@@ -0,0 +1,78 @@
+package dyndns_handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI adds the admin endpoint
+//
+//	POST /ddns/zones/invalidate
+//
+// which refreshes the cached zones of all providers, for example
+// after adding a zone at a provider.
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.ddns",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/ddns/zones/invalidate",
+			Handler: caddy.AdminHandlerFunc(a.invalidateZones),
+		},
+	}
+}
+
+func (adminAPI) invalidateZones(writer http.ResponseWriter, request *http.Request) error {
+
+	if request.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var caches = make([]*zoneCache, 0)
+
+	zoneCaches.Lock()
+
+	for cache := range zoneCaches.items {
+		caches = append(caches, cache)
+	}
+
+	zoneCaches.Unlock()
+
+	var errs = make([]error, 0)
+
+	for _, cache := range caches {
+		errs = append(errs, cache.refresh(request.Context(), false))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadGateway,
+			Err:        err,
+		}
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,162 @@
+package dyndns_handler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"go.uber.org/zap"
+)
+
+// App runs the ddns services that are not bound to a http request,
+// like the RFC 2136 dynamic update servers and the self update.
+type App struct {
+
+	// The RFC 2136 servers which accept dynamic update
+	// messages and apply them with the DNS providers.
+	RFC2136 []*RFC2136Server `json:"rfc2136,omitempty"`
+
+	// Keeps the records of the hostnames of this server
+	// up to date with its public addresses.
+	SelfUpdate *SelfUpdate `json:"self_update,omitempty"`
+
+	logger *zap.Logger
+}
+
+func init() {
+	caddy.RegisterModule(App{})
+	httpcaddyfile.RegisterGlobalOption("ddns", parseGlobalOption)
+}
+
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ddns",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+func (a *App) Provision(ctx caddy.Context) error {
+
+	a.logger = ctx.Logger()
+
+	for idx, server := range a.RFC2136 {
+		if err := server.provision(ctx, a.logger.Named("rfc2136")); err != nil {
+			return fmt.Errorf("rfc2136 server %d: %v", idx, err)
+		}
+	}
+
+	if nil != a.SelfUpdate {
+		if err := a.SelfUpdate.provision(ctx, a.logger.Named("self_update")); err != nil {
+			return fmt.Errorf("self update: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (a *App) Start() error {
+
+	for idx, server := range a.RFC2136 {
+		if err := server.start(); err != nil {
+
+			// as Stop is not called when starting fails
+			for _, started := range a.RFC2136[:idx] {
+				started.stop()
+			}
+
+			return fmt.Errorf("rfc2136 server %d: %v", idx, err)
+		}
+	}
+
+	if nil != a.SelfUpdate {
+		a.SelfUpdate.start()
+	}
+
+	return nil
+}
+
+func (a *App) Stop() error {
+
+	for _, server := range a.RFC2136 {
+		server.stop()
+	}
+
+	if nil != a.SelfUpdate {
+		a.SelfUpdate.stop()
+	}
+
+	return nil
+}
+
+func parseGlobalOption(d *caddyfile.Dispenser, existing any) (any, error) {
+
+	var app = new(App)
+
+	// the option can be given multiple times, so
+	// merge with the previous parsed config
+	if value, ok := existing.(httpcaddyfile.App); ok {
+		if err := json.Unmarshal(value.Value, app); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+
+	return httpcaddyfile.App{
+		Name:  "ddns",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// UnmarshalCaddyfile sets up the app from the global Caddyfile options. Syntax:
+//
+//	ddns {
+//		rfc2136 {
+//			...
+//		}
+//		self_update {
+//			...
+//		}
+//	}
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.Next() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "rfc2136":
+			var server = new(RFC2136Server)
+
+			if err := server.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+
+			a.RFC2136 = append(a.RFC2136, server)
+		case "self_update":
+			if nil == a.SelfUpdate {
+				a.SelfUpdate = new(SelfUpdate)
+			}
+
+			if err := a.SelfUpdate.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized ddns option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ caddy.App             = (*App)(nil)
+	_ caddy.Provisioner     = (*App)(nil)
+	_ caddyfile.Unmarshaler = (*App)(nil)
+)
@@ -2,52 +2,149 @@ package dyndns_handler
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/netip"
-	"reflect"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/libdns/libdns"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
 	"go.uber.org/zap"
 )
 
+const (
+	ProtocolDynDNS  = "dyndns2"
+	ProtocolDuckDNS = "duckdns"
+	ProtocolNoIP    = "noip"
+)
+
 type Handler struct {
 
+	// The protocol used for handling the requests, which can be
+	// "dyndns2" (default), "duckdns" or "noip".
+	Protocol string `json:"protocol,omitempty"`
+
+	// The domain which is appended to DuckDNS domains that are given
+	// without it, as DuckDNS clients mostly only send the subdomain.
+	Domain string `json:"domain,omitempty"`
+
 	// The provider configurations with which will be used
 	// to update records incoming reqeust.
 	ProvidersRaw []json.RawMessage `json:"providers,omitempty" caddy:"namespace=dns.providers inline_key=name"`
 
+	// The TTL of the created records, per zone or hostname.
+	TTL *RecordTTL `json:"ttl,omitempty"`
+
+	// What to do with hosts that are updated with offline=YES,
+	// when not set the address records are deleted.
+	Offline *Offline `json:"offline,omitempty"`
+
+	// How long the zones of the providers are cached before they
+	// are refreshed in the background. Default: 10m
+	ZonesTTL caddy.Duration `json:"zones_ttl,omitempty"`
+
 	// List of trusted remotes which will be used to determine
 	// the client ip based on x-forwarded-for header
 	TrustedRemotes *IPPrefixList `json:"trusted_remotes"`
 
+	// The header that is read for trusted remotes, which can be
+	// X-Forwarded-For (default), Forwarded (RFC 7239) or a header
+	// that holds the client ip like CF-Connecting-IP.
+	ForwardedHeader string `json:"forwarded_header,omitempty"`
+
+	// When true, the client ip resolved by caddy is used instead
+	// of the remote address of the connection. So the trusted_proxies
+	// and client_ip_headers of the server are respected.
+	UseClientIP bool `json:"use_client_ip,omitempty"`
+
 	// When true, we only satisfy by a public ip when trying
 	// to determine the client ip. This means when no ip is
 	// found, it will try to resolve "this" remote ip
 	NoLocalIp bool `json:"no_local_ip"`
 
+	// The ranges that are considered local for NoLocalIp, which
+	// are the IANA special-purpose ranges when not set.
+	LocalRanges *LocalRanges `json:"local_ranges,omitempty"`
+
+	// Restricts the addresses all hostnames can be updated with.
+	IPPolicy *IPPolicy `json:"ip_policy,omitempty"`
+
+	// Restricts the addresses per hostname (pattern), on top of
+	// the ip policies of the handler and user.
+	HostIPPolicies map[string]*IPPolicy `json:"host_ip_policies,omitempty"`
+
+	// The IPv6 suffix (interface identifier) per hostname, with which
+	// the AAAA record is derived from the myipv6prefix parameter.
+	IPv6Suffixes map[string]netip.Addr `json:"ipv6_suffixes,omitempty"`
+
+	// How "this" remote ip is resolved for NoLocalIp, when
+	// not set myip.opendns.com is resolved.
+	PublicIP *PublicIP `json:"public_ip,omitempty"`
+
 	// Because https://help.dyn.com/return-codes.html specifies
 	// that we return "badauth" (with status 200) we cannot use
 	// the basic_auth directive as it will return 401 as expected
 	// in a normal authentication request.
 	//
-	// So a username – password map will be used for authentication
-	// and when left empty, all requests will be allowed.
+	// So a username – user map will be used for authentication
+	// and when left empty, all requests will be allowed. Every
+	// user can be restricted to a list of hostnames it is allowed
+	// to update.
 	//
-	// At this moment the passwords are stored in plain text. Since
-	// the dns provider API tokens and keys are also plain text,
-	// there’s currently no real benefit for adding additional
-	// hashing or encryption mechanisms.
-	Users map[string]string `json:"users"`
-
-	providers []Provider
-	logger    *zap.Logger
+	// The passwords are stored in plain text unless a hash
+	// algorithm is configured.
+	Users map[string]*User `json:"users"`
+
+	// Path to a htpasswd-style or CSV file with additional users,
+	// which is reloaded when changed. See loadUsersFile for the
+	// format, passwords are handled the same as for Users.
+	UsersFile string `json:"users_file,omitempty"`
+
+	// How often the users file is checked for changes. Default: 10s
+	UsersFileInterval caddy.Duration `json:"users_file_interval,omitempty"`
+
+	// Name of the query parameter that holds the user token,
+	// for clients that cannot use basic authentication.
+	TokenParam string `json:"token_param,omitempty"`
+
+	// Name of the header that holds the user token. When this
+	// is the Authorization header, a Bearer token is expected.
+	TokenHeader string `json:"token_header,omitempty"`
+
+	// When set, clients will be locked out after too many
+	// failed authentication attempts.
+	Lockout *Lockout `json:"lockout,omitempty"`
+
+	// The algorithm with which the user passwords are hashed,
+	// the same as used by basic_auth. When omitted, the
+	// passwords are expected to be plain text.
+	HashRaw json.RawMessage `json:"hash,omitempty" caddy:"namespace=http.authentication.hashes inline_key=algorithm"`
+
+	// Authentication providers (http.authentication.providers.*)
+	// which will be used besides the users. On failure, badauth
+	// is returned instead of 401 and the authenticated user id
+	// is looked up in the users for the hostname permissions,
+	// so users without password can be used to only define
+	// permissions. Unknown ids are denied, unless AllowUnknownIDs
+	// is set. The providers are tried in order of their name.
+	AuthenticationRaw caddy.ModuleMap `json:"authentication,omitempty" caddy:"namespace=http.authentication.providers"`
+
+	// When true, ids authenticated by the authentication providers
+	// that are not in the users are allowed to update all hostnames.
+	AllowUnknownIDs bool `json:"allow_unknown_ids,omitempty"`
+
+	ipv6Suffixes   map[string]netip.Addr
+	providers      []Provider
+	zones          *zoneCache
+	logger         *zap.Logger
+	hash           caddyauth.Comparer
+	fakePassword   []byte
+	authenticators map[string]caddyauth.Authenticator
+	fileUsers      *atomic.Pointer[map[string]*User]
 }
 
 func init() {
@@ -65,71 +162,94 @@ func (Handler) CaddyModule() caddy.ModuleInfo {
 
 func (h *Handler) Provision(ctx caddy.Context) error {
 
-	if nil == h.providers {
-		h.providers = make([]Provider, 0)
-	}
-
 	if len(h.ProvidersRaw) == 0 {
 		return fmt.Errorf("no DNS providers defined")
 	}
 
-	val, err := ctx.LoadModule(h, "ProvidersRaw")
+	// derived before loading the modules, which clears the raw configs
+	if nil != h.Lockout && h.Lockout.StorageKey == "" {
 
-	if err != nil {
-		return fmt.Errorf("loading DNS providers module: %v", err)
+		key, err := lockoutStorageKey(h)
+
+		if err != nil {
+			return fmt.Errorf("deriving lockout storage key: %v", err)
+		}
+
+		h.Lockout.StorageKey = key
 	}
 
-	var interfaces = []reflect.Type{
-		reflect.TypeOf((*libdns.RecordAppender)(nil)).Elem(),
-		reflect.TypeOf((*libdns.RecordGetter)(nil)).Elem(),
-		reflect.TypeOf((*libdns.RecordSetter)(nil)).Elem(),
-		reflect.TypeOf((*libdns.RecordDeleter)(nil)).Elem(),
-		reflect.TypeOf((*libdns.ZoneLister)(nil)).Elem(),
+	providers, err := loadProviders(ctx, h, "ProvidersRaw")
+
+	if err != nil {
+		return err
 	}
 
-	for i, c := 0, len(val.([]interface{})); i < c; i++ {
+	h.providers = providers
 
-		var value = reflect.ValueOf(val.([]interface{})[i])
-		var missing = make([]string, 0)
-		var zoneHint = false
+	h.logger = ctx.Logger()
+	h.zones = newZoneCache(ctx, h.providers, time.Duration(h.ZonesTTL), h.logger)
+
+	switch h.Protocol {
+	case "", ProtocolDynDNS, ProtocolNoIP:
+	case ProtocolDuckDNS:
+		// DuckDNS clients always send the token as query parameter
+		if h.TokenParam == "" {
+			h.TokenParam = "token"
+		}
+	default:
+		return fmt.Errorf("unsupported protocol %s", h.Protocol)
+	}
 
-		if value.CanAddr() {
-			value = value.Elem()
+	if nil != h.PublicIP {
+		if err := h.PublicIP.provision(ctx); err != nil {
+			return err
 		}
+	}
 
-		for _, expecting := range interfaces {
+	if nil != h.Offline {
+		if err := h.Offline.provision(); err != nil {
+			return err
+		}
+	}
 
-			if false == value.Type().Implements(expecting) {
-				missing = append(missing, expecting.Name())
+	if err := h.provisionIPv6Suffixes(); err != nil {
+		return err
+	}
 
-				if "ZoneLister" == expecting.Name() {
-					zoneHint = true
-				}
-			}
-		}
+	if err := h.provisionAuthenticators(ctx); err != nil {
+		return err
+	}
 
-		if len(missing) > 0 {
+	if err := h.provisionUsers(ctx); err != nil {
+		return err
+	}
 
-			var err = fmt.Sprintf("DNS provider %s should implement ", ProviderName(value.Interface().(caddy.Module)))
+	if nil != h.Lockout {
+		if err := h.Lockout.provision(ctx, h.logger); err != nil {
+			return err
+		}
+	}
 
-			if len(missing) == 1 {
-				err += "libdns." + missing[0]
-			} else {
-				err += "libdns.{" + strings.Join(missing, ", ") + "}"
-			}
+	return h.provisionUsersFile(ctx)
+}
 
-			if zoneHint {
-				err += " (use provider ddns.static_zones to manually define zones)"
-			}
+func (h *Handler) provisionAuthenticators(ctx caddy.Context) error {
 
-			return errors.New(err)
+	h.authenticators = make(map[string]caddyauth.Authenticator)
 
-		}
+	if len(h.AuthenticationRaw) == 0 {
+		return nil
+	}
 
-		h.providers = append(h.providers, value.Interface().(Provider))
+	mods, err := ctx.LoadModule(h, "AuthenticationRaw")
+
+	if err != nil {
+		return fmt.Errorf("loading authentication providers: %v", err)
 	}
 
-	h.logger = ctx.Logger()
+	for name, module := range mods.(map[string]any) {
+		h.authenticators[name] = module.(caddyauth.Authenticator)
+	}
 
 	return nil
 }
@@ -147,14 +267,54 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 // UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
 //
 //	ddns {
+//		protocol dyndns2|duckdns|noip
+//		domain <domain>
 //	    provider 	{
 //	    	<name> ...
 //		}
 //		no_local_ip
-//		users {
+//		local_ranges [<ip prefix>...] {
+//			add <ip prefix>...
+//			remove <ip prefix>...
+//		}
+//		ip_policy [<hostname|pattern>] {
+//			...
+//		}
+//		ipv6_suffixes {
+//			<hostname> <suffix>
+//		}
+//		public_ip {
+//			...
+//		}
+//		offline delete|ip|cname [<address>...|<target>]
+//		zones_ttl <duration>
+//		ttl [<duration>] {
+//			...
+//		}
+//		users [<hash_algorithm>] {
 //			username password
+//			username [password] {
+//				hosts <hostname|pattern>...
+//				token <token>
+//				parameters none|<wildcard|mx|backmx|offline|txt|myipv6prefix|mylanip>...
+//				ip_policy {
+//					...
+//				}
+//			}
+//		}
+//		users_file <path> [<interval>]
+//		token_param <name>
+//		token_header <name>
+//		lockout {
+//			...
+//		}
+//		authentication {
+//			<provider> ...
 //		}
+//		allow_unknown_ids
 //		trusted_remotes <ip prefix>...
+//		forwarded_header <name>
+//		use_client_ip
 //	}
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
@@ -166,22 +326,130 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		switch d.Val() {
 		case "providers":
 
-			h.ProvidersRaw = make([]json.RawMessage, 0)
+			providers, err := unmarshalProviders(d)
+
+			if err != nil {
+				return err
+			}
+
+			h.ProvidersRaw = providers
+		case "users_file":
+			var args = d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			h.UsersFile = args[0]
+			if len(args) == 2 {
+				interval, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("invalid users file interval: %v", err)
+				}
+				h.UsersFileInterval = caddy.Duration(interval)
+			}
+		case "token_param":
+			if !d.AllArgs(&h.TokenParam) {
+				return d.ArgErr()
+			}
+		case "token_header":
+			if !d.AllArgs(&h.TokenHeader) {
+				return d.ArgErr()
+			}
+		case "lockout":
+			h.Lockout = new(Lockout)
+			if err := h.Lockout.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "allow_unknown_ids":
+			h.AllowUnknownIDs = true
+		case "authentication":
+
+			h.AuthenticationRaw = make(caddy.ModuleMap)
 
 			for nesting := d.Nesting(); d.NextBlock(nesting); {
 
 				var name = d.Val()
 
-				encoder, err := caddyfile.UnmarshalModule(d, "dns.providers."+name)
+				if _, x := h.AuthenticationRaw[name]; x {
+					return d.Errf("duplicate authentication provider %s", name)
+				}
+
+				unm, err := caddyfile.UnmarshalModule(d, "http.authentication.providers."+name)
 
 				if err != nil {
 					return err
 				}
 
-				h.ProvidersRaw = append(h.ProvidersRaw, caddyconfig.JSONModuleObject(encoder, "name", name, nil))
+				h.AuthenticationRaw[name] = caddyconfig.JSON(unm, nil)
+			}
+		case "protocol":
+			if !d.AllArgs(&h.Protocol) {
+				return d.ArgErr()
+			}
+		case "domain":
+			if !d.AllArgs(&h.Domain) {
+				return d.ArgErr()
+			}
+		case "ttl":
+			h.TTL = new(RecordTTL)
+			if err := h.TTL.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "public_ip":
+			h.PublicIP = new(PublicIP)
+			if err := h.PublicIP.UnmarshalCaddyfile(d); err != nil {
+				return err
 			}
+		case "offline":
+			h.Offline = new(Offline)
+			if err := h.Offline.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "zones_ttl":
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid zones ttl: %v", err)
+			}
+			h.ZonesTTL = caddy.Duration(ttl)
 		case "no_local_ip":
 			h.NoLocalIp = true
+		case "ip_policy":
+			var policy = new(IPPolicy)
+			switch args := d.RemainingArgs(); len(args) {
+			case 0:
+				h.IPPolicy = policy
+			case 1:
+				if nil == h.HostIPPolicies {
+					h.HostIPPolicies = make(map[string]*IPPolicy)
+				}
+				if _, x := h.HostIPPolicies[args[0]]; x {
+					return d.Errf("duplicate ip_policy for %s", args[0])
+				}
+				h.HostIPPolicies[args[0]] = policy
+			default:
+				return d.ArgErr()
+			}
+			if err := policy.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "ipv6_suffixes":
+			if err := h.unmarshalIPv6Suffixes(d); err != nil {
+				return err
+			}
+		case "local_ranges":
+			h.LocalRanges = new(LocalRanges)
+			if err := h.LocalRanges.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "use_client_ip":
+			h.UseClientIP = true
+		case "forwarded_header":
+			if !d.AllArgs(&h.ForwardedHeader) {
+				return d.ArgErr()
+			}
 		case "trusted_remotes":
 			var args = d.RemainingArgs()
 			if len(args) == 0 {
@@ -198,18 +466,61 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				*h.TrustedRemotes = append(*h.TrustedRemotes, prefix)
 			}
 		case "users":
-			h.Users = make(map[string]string)
+			switch args := d.RemainingArgs(); len(args) {
+			case 0:
+			case 1:
+				if _, err := caddy.GetModule("http.authentication.hashes." + args[0]); err != nil {
+					return d.Errf("unrecognized hash algorithm: %s", args[0])
+				}
+				h.HashRaw = caddyconfig.JSONModuleObject(struct{}{}, "algorithm", args[0], nil)
+			default:
+				return d.ArgErr()
+			}
+			h.Users = make(map[string]*User)
 			for nesting := d.Nesting(); d.NextBlock(nesting); {
 				var name = d.Val()
-				var passwd string
-				d.Args(&passwd)
-				if d.NextArg() {
+				var args = d.RemainingArgs()
+				if len(args) > 1 {
 					return d.ArgErr()
 				}
 				if _, x := h.Users[name]; x {
 					return d.Errf("duplicate user %s", name)
 				}
-				h.Users[name] = passwd
+				var user = new(User)
+				if len(args) == 1 {
+					user.Password = args[0]
+				}
+				for sub := d.Nesting(); d.NextBlock(sub); {
+					switch d.Val() {
+					case "hosts":
+						var hosts = d.RemainingArgs()
+						if len(hosts) == 0 {
+							return d.Errf("must specify at least one host")
+						}
+						user.Hosts = append(user.Hosts, hosts...)
+					case "token":
+						if !d.AllArgs(&user.Token) {
+							return d.ArgErr()
+						}
+					case "parameters":
+						var params = d.RemainingArgs()
+						if len(params) == 0 {
+							return d.Errf("must specify at least one parameter")
+						}
+						if nil == user.Parameters {
+							user.Parameters = make([]string, 0)
+						}
+						user.Parameters = append(user.Parameters, parseParameters(params)...)
+					case "ip_policy":
+						user.IPPolicy = new(IPPolicy)
+						if err := user.IPPolicy.UnmarshalCaddyfile(d); err != nil {
+							return err
+						}
+					default:
+						return d.Errf("unrecognized user option '%s'", d.Val())
+					}
+				}
+				h.Users[name] = user
 			}
 		}
 	}
@@ -220,7 +531,10 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 func ProviderName(module caddy.Module) string {
 	var name = module.CaddyModule().ID.Name()
 
-	if v, ok := module.(*StaticZonesProvider); ok {
+	switch v := module.(type) {
+	case *StaticZonesProvider:
+		name += "(" + v.provider.(caddy.Module).CaddyModule().ID.Name() + ")"
+	case *OptionsProvider:
 		name += "(" + v.provider.(caddy.Module).CaddyModule().ID.Name() + ")"
 	}
 
@@ -0,0 +1,179 @@
+package dyndns_handler
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// authenticate checks the lockout and authorizes the request, it
+// returns the Abuse or BadAuthentication code when not allowed.
+func (h *Handler) authenticate(request *http.Request) (*User, ReturnCode) {
+
+	if h.Lockout.Locked(request) {
+		return nil, Abuse
+	}
+
+	user, ok := h.authorize(request)
+
+	if false == ok {
+		h.Lockout.Failed(request)
+		return nil, BadAuthentication
+	}
+
+	h.Lockout.Succeeded(request)
+
+	return user, ""
+}
+
+// authorize will validate the request credentials and returns the
+// matching user, which is nil when no users are configured or when
+// an authentication provider authenticated an unknown user (only
+// with AllowUnknownIDs).
+func (h *Handler) authorize(request *http.Request) (*User, bool) {
+
+	if false == h.hasUsers() && len(h.authenticators) == 0 {
+		h.logger.Debug("authorisation ok, no user configured")
+		return nil, true
+	}
+
+	if name, passwd, ok := request.BasicAuth(); ok && h.hasPasswords() {
+		if user := h.lookupUser(name); h.checkPassword(user, passwd) {
+			h.logger.Debug("authorisation ok", zap.String("user", name))
+			setUserPlaceholder(request, name)
+			return user, true
+		}
+	}
+
+	if token := h.getToken(request); token != "" {
+		if name, user, ok := h.checkToken(token); ok {
+			h.logger.Debug("authorisation ok", zap.String("user", name), zap.String("method", "token"))
+			setUserPlaceholder(request, name)
+			return user, true
+		}
+	}
+
+	// sorted, so the same provider authenticates the request every time
+	for _, name := range slices.Sorted(maps.Keys(h.authenticators)) {
+
+		user, ok, err := h.authenticators[name].Authenticate(&authResponseWriter{header: make(http.Header)}, request)
+
+		if err != nil {
+			h.logger.Error("auth provider returned error", zap.String("provider", name), zap.Error(err))
+			continue
+		}
+
+		if false == ok {
+			continue
+		}
+
+		var known = h.lookupUser(user.ID)
+
+		if nil == known && false == h.AllowUnknownIDs {
+			h.logger.Warn("authorisation failed, unknown user", zap.String("user", user.ID), zap.String("provider", name))
+			continue
+		}
+
+		h.logger.Debug("authorisation ok", zap.String("user", user.ID), zap.String("provider", name))
+		setUserPlaceholder(request, user.ID)
+		return known, true
+	}
+
+	h.logger.Debug("authorisation failed, no valid credentials")
+	return nil, false
+}
+
+// getToken returns the token from the configured query
+// parameter or header, or an empty string when not found.
+func (h *Handler) getToken(request *http.Request) string {
+
+	if h.TokenParam != "" {
+		if value := request.URL.Query().Get(h.TokenParam); value != "" {
+			return value
+		}
+	}
+
+	if h.TokenHeader != "" {
+
+		var value = request.Header.Get(h.TokenHeader)
+
+		if strings.EqualFold(h.TokenHeader, "Authorization") {
+			if len(value) < 7 || false == strings.EqualFold(value[:7], "Bearer ") {
+				return ""
+			}
+			value = value[7:]
+		}
+
+		return strings.TrimSpace(value)
+	}
+
+	return ""
+}
+
+// hasPasswords returns true when at least one user has
+// a password, so we can skip the (possibly expensive)
+// password compare when only providers are used.
+func (h *Handler) hasPasswords() bool {
+	for _, user := range h.Users {
+		if len(user.password) > 0 {
+			return true
+		}
+	}
+	if users := h.fileUsers.Load(); users != nil {
+		for _, user := range *users {
+			if len(user.password) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasUsers returns true when users are defined in the
+// config or in the users file.
+func (h *Handler) hasUsers() bool {
+	return len(h.Users) > 0 || h.UsersFile != ""
+}
+
+// lookupUser returns the user with the given name, where users
+// defined in the config take precedence over the users file.
+func (h *Handler) lookupUser(name string) *User {
+
+	if user, ok := h.Users[name]; ok {
+		return user
+	}
+
+	if users := h.fileUsers.Load(); users != nil {
+		return (*users)[name]
+	}
+
+	return nil
+}
+
+func setUserPlaceholder(request *http.Request, id string) {
+	if repl, ok := request.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.auth.user.id", id)
+	}
+}
+
+// authResponseWriter is given to the authentication providers,
+// so they cannot change the response (like setting a status 401
+// or WWW-Authenticate header) because clients expect badauth
+// with status 200.
+type authResponseWriter struct {
+	header http.Header
+}
+
+func (a *authResponseWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *authResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (a *authResponseWriter) WriteHeader(int) {}
@@ -0,0 +1,77 @@
+package dyndns_handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// staticAuthenticator authenticates every request as the given id,
+// and like basic_auth it responds with 401 when it has no id.
+type staticAuthenticator struct {
+	id string
+}
+
+func (s staticAuthenticator) Authenticate(writer http.ResponseWriter, _ *http.Request) (caddyauth.User, bool, error) {
+
+	if s.id == "" {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return caddyauth.User{}, false, nil
+	}
+
+	return caddyauth.User{ID: s.id}, true, nil
+}
+
+func TestAuthorizeProviders(t *testing.T) {
+
+	var users = map[string]*User{"foo": {Hosts: []string{"foo.example.com"}}}
+
+	var tests = []struct {
+		name    string
+		id      string
+		unknown bool
+		allowed bool
+		user    *User
+	}{
+		{"known id", "foo", false, true, users["foo"]},
+		{"unknown id", "bar", false, false, nil},
+		{"unknown id allowed", "bar", true, true, nil},
+		{"not authenticated", "", true, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var handler = newTestHandler(t, users)
+
+			handler.AllowUnknownIDs = test.unknown
+			handler.authenticators = map[string]caddyauth.Authenticator{"static": staticAuthenticator{id: test.id}}
+
+			user, allowed := handler.authorize(httptest.NewRequest("GET", "/nic/update", nil))
+
+			if allowed != test.allowed || user != test.user {
+				t.Fatalf("expected %t and user %v, got %t and %v", test.allowed, test.user, allowed, user)
+			}
+		})
+	}
+}
+
+func TestServeProviderBadAuth(t *testing.T) {
+
+	var handler = newTestHandler(t, map[string]*User{"foo": {}})
+
+	handler.authenticators = map[string]caddyauth.Authenticator{"static": staticAuthenticator{}}
+
+	var recorder = httptest.NewRecorder()
+
+	if err := handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/nic/update?hostname=foo.example.com", nil), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// clients expect badauth with status 200 instead of the 401 of the provider
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "badauth" {
+		t.Fatalf("expected badauth with status 200, got %q with status %d", recorder.Body.String(), recorder.Code)
+	}
+}
@@ -0,0 +1,55 @@
+package dyndns_handler
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// ParamTXT is the parameter to set the TXT record for the ACME DNS-01
+// challenge of the hostnames, so machines without access to the DNS
+// provider can still obtain (wildcard) certificates.
+const ParamTXT = "txt"
+
+// challengeName returns the name of the DNS-01 challenge record of the
+// hostname, where the challenge of *.example.com is the same as the one
+// of example.com.
+func challengeName(hostname string) string {
+	return "_acme-challenge." + strings.TrimPrefix(hostname, "*.")
+}
+
+// setChallenges adds or removes the challenge TXT records for the hosts.
+// The value is appended to the existing records, so the challenges of a
+// domain and its wildcard can be presented at the same time. With
+// clear=true the given value (or all values when empty) is removed.
+func (h *Handler) setChallenges(ctx context.Context, query url.Values, hosts []string, zones [][]string, results []ReturnCode) {
+
+	var value = query.Get(ParamTXT)
+	var clear = strings.EqualFold(query.Get("clear"), "true")
+
+	var updates = h.makeChangeLists(hosts, zones, &results, func(hostname, zone string, ttl time.Duration) []libdns.Record {
+
+		var name = libdns.RelativeName(challengeName(hostname), zone)
+
+		if clear && value == "" {
+			return []libdns.Record{libdns.RR{Name: name, Type: "TXT"}}
+		}
+
+		// without TTL, so the record is also removed when the TTL
+		// was changed (by the provider or in the config)
+		if clear {
+			return []libdns.Record{libdns.TXT{Name: name, Text: value}}
+		}
+
+		return []libdns.Record{libdns.TXT{Name: name, TTL: ttl, Text: value}}
+	})
+
+	if clear {
+		h.applyChangeLists(ctx, updates, NewSemaphore(5), BaseProvider.DeleteRecords, false, Good, results)
+	} else {
+		h.applyChangeLists(ctx, updates, NewSemaphore(5), appendMissingRecords, false, Good, results)
+	}
+}
@@ -0,0 +1,40 @@
+package dyndns_handler
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func TestChallenges(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com."}
+	var handler = newTestHandler(t, nil, provider)
+
+	// the same challenge for the domain and its wildcard is only added once
+	serveRequest(t, handler, "/nic/update?hostname=nas.example.com,*.nas.example.com&txt=first", "", "")
+	serveRequest(t, handler, "/nic/update?hostname=nas.example.com&txt=second", "", "")
+
+	if lines := provider.lines(); false == slices.Equal(lines, []string{"_acme-challenge.nas TXT first", "_acme-challenge.nas TXT second"}) {
+		t.Fatalf("expected both challenges, got %q", lines)
+	}
+
+	// a TTL that differs from the configured TTL should not matter
+	provider.records[0].TTL = 2 * time.Minute
+
+	serveRequest(t, handler, "/nic/update?hostname=nas.example.com&txt=first&clear=true", "", "")
+
+	if lines := provider.lines(); false == slices.Equal(lines, []string{"_acme-challenge.nas TXT second"}) {
+		t.Fatalf("expected the first challenge to be removed, got %q", lines)
+	}
+
+	provider.records = append(provider.records, libdns.RR{Name: "_acme-challenge.nas", Type: "TXT", Data: "third"})
+
+	serveRequest(t, handler, "/nic/update?hostname=nas.example.com&txt=&clear=true", "", "")
+
+	if lines := provider.lines(); len(lines) != 0 {
+		t.Fatalf("expected all challenges to be removed, got %q", lines)
+	}
+}
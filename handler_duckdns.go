@@ -0,0 +1,192 @@
+package dyndns_handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// serveDuckDNS will handle incoming request as described in
+//
+//	https://www.duckdns.org/spec.jsp
+//
+// and returns OK when all domains were updated or KO otherwise. The
+// internal providers are updated the same as with dyndns2, see
+// updateInternal.
+func (h *Handler) serveDuckDNS(response http.ResponseWriter, request *http.Request) error {
+
+	var query = request.URL.Query()
+	var verbose = strings.EqualFold(query.Get("verbose"), "true")
+	var clear = strings.EqualFold(query.Get("clear"), "true")
+
+	user, code := h.authenticate(request)
+
+	if code != "" {
+		return h.writeDuckDNS(response, nil, []ReturnCode{code}, false)
+	}
+
+	if query.Get("domains") == "" {
+		return h.writeDuckDNS(response, nil, []ReturnCode{NotFullyQualifiedDomainName}, false)
+	}
+
+	var hosts, results = getHosts(h.getDuckDNSDomains(query.Get("domains")))
+	var lock = NewSemaphore(5)
+
+	if len(hosts) > maxHosts {
+		h.logger.Warn(fmt.Sprintf("too many domains, got %d where the maximum is %d", len(hosts), maxHosts))
+		return h.writeDuckDNS(response, nil, []ReturnCode{NumHost}, false)
+	}
+
+	if name, ok := checkParameters(user, query); !ok {
+		h.logger.Warn(fmt.Sprintf("parameter %s not allowed for user", name))
+		return h.writeDuckDNS(response, hosts, h.setReturnCodes(results, NotDonator), false)
+	}
+
+	h.checkHostPermissions(user, hosts, results)
+
+	var all = h.zones.Get(request.Context())
+	var zones = h.viewZones(all, ViewPublic)
+
+	if query.Has(ParamTXT) {
+
+		h.logger.Info("duckdns txt request", zap.Strings("hosts", hosts), zap.Bool("clear", clear))
+
+		// the same as the dyndns2 txt parameter, so concurrent
+		// challenges (of a domain and its wildcard) are kept
+		h.setChallenges(request.Context(), query, hosts, zones, results)
+
+		if false == verbose {
+			return h.writeDuckDNS(response, hosts, results, false)
+		}
+
+		return h.writeDuckDNS(response, hosts, results, true, query.Get(ParamTXT), "")
+	}
+
+	if clear {
+
+		h.logger.Info("duckdns clear request", zap.Strings("hosts", hosts))
+
+		var internal = slices.Clone(results)
+		var updates = h.makeChangeLists(hosts, zones, &results, typeRecords("A", "AAAA"))
+
+		h.applyChangeLists(request.Context(), updates, lock, BaseProvider.DeleteRecords, false, Good, results)
+
+		if h.hasView(ViewInternal) {
+			h.applyChangeLists(request.Context(), h.makeChangeLists(hosts, h.viewZones(all, ViewInternal), &internal, typeRecords("A", "AAAA")), lock, BaseProvider.DeleteRecords, false, Good, internal)
+			mergeViewResults(results, internal)
+		}
+
+		return h.writeDuckDNS(response, hosts, results, verbose, "", "")
+	}
+
+	// both the ip and ipv6 parameters can be given to update
+	// the A and AAAA records, without the ip will be detected
+	var params = url.Values{"myip": {query.Get("ip")}, "myipv6": {query.Get("ipv6")}}
+
+	ips, err := getAddresses(params, request, h)
+
+	if err != nil {
+		h.logger.Error("could not determine ip", zap.Error(err))
+		return h.writeDuckDNS(response, hosts, h.setReturnCodes(results, DNSError), false)
+	}
+
+	h.logger.Info(
+		"duckdns update request",
+		zap.Stringers("ips", ips),
+		zap.Strings("hosts", hosts),
+		zap.String("user agent", request.Header.Get("user-agent")),
+	)
+
+	h.checkIPPolicies(request, user, hosts, h.hostAddresses(netip.Prefix{}, ips), netip.Prefix{}, ViewPublic, results)
+
+	// after the policy check, so a rejected host is not updated at all
+	var internal = slices.Clone(results)
+	var updates = h.makeChangeLists(hosts, zones, &results, addressRecords(ips))
+
+	h.applyChangeLists(request.Context(), updates, lock, BaseProvider.SetRecords, true, Good, results)
+
+	if h.hasView(ViewInternal) {
+		h.updateInternal(request, query, user, hosts, all, internal)
+		mergeViewResults(results, internal)
+	}
+
+	var lines = make([]string, 2)
+
+	for _, ip := range ips {
+		if ip.Is4() {
+			lines[0] = ip.String()
+		} else {
+			lines[1] = ip.String()
+		}
+	}
+
+	return h.writeDuckDNS(response, hosts, results, verbose, lines...)
+}
+
+// getDuckDNSDomains appends the configured domain to the given domains
+// that are not already within, because DuckDNS clients mostly only send
+// the subdomain (like "foo" for foo.duckdns.org).
+func (h *Handler) getDuckDNSDomains(value string) string {
+
+	if h.Domain == "" {
+		return value
+	}
+
+	var domains = strings.Split(value, ",")
+	var suffix = "." + strings.Trim(h.Domain, ".")
+
+	for idx, domain := range domains {
+		if false == strings.HasSuffix(domain, suffix) && domain != suffix[1:] {
+			domains[idx] = domain + suffix
+		}
+	}
+
+	return strings.Join(domains, ",")
+}
+
+// writeDuckDNS writes OK when all hosts are updated (or unchanged), or KO
+// otherwise. In verbose mode, the given lines are added with UPDATED or
+// NOCHANGE as last line.
+func (h *Handler) writeDuckDNS(writer http.ResponseWriter, hosts []string, codes []ReturnCode, verbose bool, lines ...string) error {
+
+	var status = "OK"
+	var changed = "NOCHANGE"
+	var fields = make([]zap.Field, len(codes))
+
+	for idx, code := range codes {
+
+		switch code {
+		case Good:
+			changed = "UPDATED"
+		case NoChange:
+		default:
+			status = "KO"
+		}
+
+		if len(hosts) == len(codes) {
+			fields[idx] = zap.String(hosts[idx], string(code))
+		} else {
+			fields[idx] = zap.String("code", string(code))
+		}
+	}
+
+	h.logger.Info("duckdns update response", fields...)
+
+	var buf = status
+
+	if verbose && status == "OK" {
+		for _, line := range lines {
+			buf += "\n" + line
+		}
+		buf += "\n" + changed
+	}
+
+	_, err := writer.Write([]byte(buf))
+
+	return err
+}
@@ -0,0 +1,61 @@
+package dyndns_handler
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDuckDNSMaxHosts(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com."}
+	var handler = newTestHandler(t, nil, provider)
+	var domains = make([]string, maxHosts+1)
+
+	for idx := range domains {
+		domains[idx] = fmt.Sprintf("host%d", idx)
+	}
+
+	handler.Protocol = ProtocolDuckDNS
+	handler.Domain = "example.com"
+
+	if body := serveRequest(t, handler, "/update?domains="+strings.Join(domains, ",")+"&ip=198.51.100.1", "", ""); body != "KO" {
+		t.Fatalf("expected KO, got %q", body)
+	}
+
+	if lines := provider.lines(); len(lines) != 0 {
+		t.Fatalf("expected no records, got %q", lines)
+	}
+}
+
+func TestDuckDNSInternalView(t *testing.T) {
+
+	var public = &memoryProvider{zone: "example.com."}
+	var internal = &memoryProvider{zone: "example.com."}
+	var handler = newTestHandler(t, nil, public, &OptionsProvider{View: ViewInternal, provider: internal})
+
+	handler.Protocol = ProtocolDuckDNS
+	handler.Domain = "example.com"
+
+	// the internal view is updated with the address of the client
+	if body := serveRequest(t, handler, "/update?domains=nas&ip=198.51.100.1", "", ""); body != "OK" {
+		t.Fatalf("expected OK, got %q", body)
+	}
+
+	if lines := public.lines(); false == slices.Equal(lines, []string{"nas A 198.51.100.1"}) {
+		t.Fatalf("expected the public address, got %q", lines)
+	}
+
+	if lines := internal.lines(); false == slices.Equal(lines, []string{"nas A 192.0.2.10"}) {
+		t.Fatalf("expected the address of the client, got %q", lines)
+	}
+
+	if body := serveRequest(t, handler, "/update?domains=nas&clear=true", "", ""); body != "OK" {
+		t.Fatalf("expected OK, got %q", body)
+	}
+
+	if len(public.lines()) != 0 || len(internal.lines()) != 0 {
+		t.Fatalf("expected the records to be removed in both views, got %q and %q", public.lines(), internal.lines())
+	}
+}
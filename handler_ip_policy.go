@@ -0,0 +1,193 @@
+package dyndns_handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// IPPolicy restricts the addresses a hostname can be updated with, so a
+// client cannot publish for example an address of someone else's network.
+type IPPolicy struct {
+
+	// When set, only addresses within these ranges are allowed
+	Allow IPPrefixList `json:"allow,omitempty"`
+
+	// Addresses within these ranges are never allowed
+	Deny IPPrefixList `json:"deny,omitempty"`
+
+	// When true, local addresses (see Handler.LocalRanges)
+	// like 0.0.0.0, multicast or private ranges are denied.
+	PublicOnly bool `json:"public_only,omitempty"`
+
+	// When true, the address must be equal to the address of the client,
+	// as determined when no address is given. Addresses of the other family
+	// than the client are only allowed when covered by Allow, and addresses
+	// derived from an IPv6 prefix (see Handler.IPv6Suffixes) are not compared.
+	MatchSource bool `json:"match_source,omitempty"`
+}
+
+// allows checks if the policy accepts the address, where local reports
+// whether the address is local for PublicOnly and source is called for
+// the address of the client when needed. A nil source skips MatchSource.
+func (p *IPPolicy) allows(ip netip.Addr, local func(ip netip.Addr) bool, source func() netip.Addr) bool {
+
+	if nil == p {
+		return true
+	}
+
+	ip = ip.Unmap()
+
+	if p.Deny.Contains(ip) {
+		return false
+	}
+
+	if len(p.Allow) > 0 && false == p.Allow.Contains(ip) {
+		return false
+	}
+
+	if p.PublicOnly && local(ip) {
+		return false
+	}
+
+	if p.MatchSource && nil != source {
+
+		var client = source()
+
+		if false == client.IsValid() {
+			return false
+		}
+
+		// the address of the other family cannot be compared, so
+		// it has to be explicitly allowed with an allow range
+		if client.Is4() != ip.Is4() {
+			return p.Allow.Contains(ip)
+		}
+
+		if ip != client {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ipPolicies returns the policies that apply for the user and hostname,
+// which are the one of the handler, the user and all matching hostname
+// patterns.
+func (h *Handler) ipPolicies(user *User, hostname string) []*IPPolicy {
+
+	var policies = make([]*IPPolicy, 0)
+
+	if nil != h.IPPolicy {
+		policies = append(policies, h.IPPolicy)
+	}
+
+	if nil != user && nil != user.IPPolicy {
+		policies = append(policies, user.IPPolicy)
+	}
+
+	for pattern, policy := range h.HostIPPolicies {
+		if matchHostname(pattern, hostname) {
+			policies = append(policies, policy)
+		}
+	}
+
+	return policies
+}
+
+// checkIPPolicies marks the hosts that may not be updated with (one of)
+// their addresses with BadIP. For the internal view the addresses are LAN
+// addresses, so public_only does not apply and match_source compares with
+// the address of the client without resolving the public address. The
+// addresses derived from the prefix are not compared with the client.
+func (h *Handler) checkIPPolicies(request *http.Request, user *User, hosts []string, addresses func(hostname string) []netip.Addr, prefix netip.Prefix, view string, results []ReturnCode) {
+
+	var local = h.LocalRanges.Contains
+
+	if view == ViewInternal {
+		local = func(netip.Addr) bool { return false }
+	}
+
+	var source = sync.OnceValue(func() netip.Addr {
+
+		ip, err := getClientIp(request, h, view == ViewPublic && h.NoLocalIp)
+
+		if err != nil {
+			h.logger.Warn("could not determine client ip for ip policy", zap.Error(err))
+		}
+
+		return ip.Unmap()
+	})
+
+	for idx, hostname := range hosts {
+
+		// already resolved, for example because
+		// the user is not allowed to update it
+		if results[idx] != NoChange {
+			continue
+		}
+
+		var derived, hasDerived = h.derivedAddress(prefix, hostname)
+
+	policies:
+		for _, policy := range h.ipPolicies(user, hostname) {
+			for _, ip := range addresses(hostname) {
+
+				var client = source
+
+				if hasDerived && ip == derived {
+					client = nil
+				}
+
+				if false == policy.allows(ip, local, client) {
+					h.logger.Warn(fmt.Sprintf("address %s not allowed for hostname %s", ip, hostname), zap.String("remote", clientIP(request)))
+					results[idx] = BadIP
+					break policies
+				}
+			}
+		}
+	}
+}
+
+// UnmarshalCaddyfile sets up the ip policy from Caddyfile tokens. Syntax:
+//
+//	ip_policy [<hostname|pattern>] {
+//		allow <ip prefix>...
+//		deny <ip prefix>...
+//		public_only
+//		match_source
+//	}
+//
+// The hostname is handled by the caller, as it only applies to the handler.
+func (p *IPPolicy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "allow":
+			if err := parsePrefixes(d, d.RemainingArgs(), &p.Allow); err != nil {
+				return err
+			}
+		case "deny":
+			if err := parsePrefixes(d, d.RemainingArgs(), &p.Deny); err != nil {
+				return err
+			}
+		case "public_only":
+			p.PublicOnly = true
+		case "match_source":
+			p.MatchSource = true
+		default:
+			return d.Errf("unrecognized ip_policy option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ caddyfile.Unmarshaler = (*IPPolicy)(nil)
+)
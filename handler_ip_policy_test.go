@@ -0,0 +1,46 @@
+package dyndns_handler
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIPPolicyMatchSource(t *testing.T) {
+
+	var policy = &IPPolicy{MatchSource: true}
+	var allowing = &IPPolicy{MatchSource: true, Allow: IPPrefixList{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("2001:db8:1200::/48")}}
+
+	var client = func(value string) func() netip.Addr {
+		return func() netip.Addr {
+
+			var ip, _ = netip.ParseAddr(value)
+
+			return ip
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		policy  *IPPolicy
+		ip      string
+		source  func() netip.Addr
+		allowed bool
+	}{
+		{"same family match", policy, "198.51.100.1", client("198.51.100.1"), true},
+		{"same family mismatch", policy, "198.51.100.2", client("198.51.100.1"), false},
+		{"same family match ipv6", policy, "2001:db8::1", client("2001:db8::1"), true},
+		{"other family", policy, "2001:db8:1200::1", client("198.51.100.1"), false},
+		{"other family allowed", allowing, "2001:db8:1200::1", client("198.51.100.1"), true},
+		{"other family outside allow", allowing, "2001:db8:1300::1", client("198.51.100.1"), false},
+		{"invalid client", policy, "198.51.100.1", client(""), false},
+		{"derived address", policy, "2001:db8:1200::1", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := test.policy.allows(netip.MustParseAddr(test.ip), nil, test.source); allowed != test.allowed {
+				t.Fatalf("expected %t for %s, got %t", test.allowed, test.ip, allowed)
+			}
+		})
+	}
+}
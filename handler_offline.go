@@ -0,0 +1,330 @@
+package dyndns_handler
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+const (
+	OfflineDelete = "delete"
+	OfflineIP     = "ip"
+	OfflineCNAME  = "cname"
+)
+
+// Offline configures what happens with hosts that are updated with
+// offline=YES, see https://help.dyn.com/remote-access-api/perform-update/
+type Offline struct {
+
+	// What to do with an offline host, which can be "delete" (default) to
+	// remove the address records, "ip" to point the host to the parking
+	// addresses or "cname" to replace the address records with a CNAME.
+	Mode string `json:"mode,omitempty"`
+
+	// The parking addresses used with mode "ip"
+	Addresses []string `json:"addresses,omitempty"`
+
+	// The target of the CNAME used with mode "cname"
+	Target string `json:"target,omitempty"`
+
+	addresses []netip.Addr
+}
+
+func (o *Offline) provision() error {
+
+	switch o.Mode {
+	case "", OfflineDelete:
+		o.Mode = OfflineDelete
+	case OfflineIP:
+
+		if len(o.Addresses) == 0 {
+			return fmt.Errorf("offline mode ip requires at least one address")
+		}
+
+		o.addresses = make([]netip.Addr, len(o.Addresses))
+
+		for idx, value := range o.Addresses {
+
+			addr, err := netip.ParseAddr(value)
+
+			if err != nil {
+				return fmt.Errorf("invalid offline address: %v", err)
+			}
+
+			o.addresses[idx] = addr.Unmap()
+		}
+	case OfflineCNAME:
+		if o.Target == "" {
+			return fmt.Errorf("offline mode cname requires a target")
+		}
+	default:
+		return fmt.Errorf("unsupported offline mode %s", o.Mode)
+	}
+
+	return nil
+}
+
+// isOffline checks the offline parameter, which is YES or NO
+// according to the spec, but is handled case-insensitive.
+func isOffline(value string) bool {
+	return strings.EqualFold(value, "yes")
+}
+
+// setOffline applies the configured offline mode to the hosts, where the
+// address records are removed first when not replaced by the new records.
+// The *.<host> records (see ParamWildcard) are taken offline the same way,
+// when the host has them. The returned addresses are the parking addresses
+// for mode ip.
+func (h *Handler) setOffline(ctx context.Context, hosts []string, zones [][]string, results []ReturnCode) []netip.Addr {
+
+	var lock = NewSemaphore(5)
+	var offline = h.Offline
+
+	if nil == offline {
+		offline = &Offline{Mode: OfflineDelete}
+	}
+
+	var wildcards = make(map[string]bool)
+
+	if offline.Mode != OfflineDelete {
+		for hostname, records := range h.wildcardRecords(ctx, hosts, zones, results) {
+			wildcards[hostname] = slices.ContainsFunc(records, func(record libdns.RR) bool {
+				return record.Type == "A" || record.Type == "AAAA" || (record.Type == "CNAME" && offline.isTarget(record.Data))
+			})
+		}
+	}
+
+	switch offline.Mode {
+	case OfflineIP:
+
+		var types = make([]string, 0)
+
+		for _, kind := range []string{"A", "AAAA"} {
+			if false == hasAddressType(offline.addresses, kind) {
+				types = append(types, kind)
+			}
+		}
+
+		var deletes = h.makeChangeLists(hosts, zones, &results, withWildcards(typeRecords(types...), wildcards))
+		var updates = h.makeChangeLists(hosts, zones, &results, withWildcards(addressRecords(offline.addresses), wildcards))
+
+		h.applyChangeLists(ctx, deletes, lock, BaseProvider.DeleteRecords, false, Good, results)
+		h.applyChangeLists(ctx, updates, lock, BaseProvider.SetRecords, true, Good, results)
+
+		return offline.addresses
+	case OfflineCNAME:
+
+		var deletes = h.makeChangeLists(hosts, zones, &results, withWildcards(typeRecords("A", "AAAA"), wildcards))
+		var updates = h.makeChangeLists(hosts, zones, &results, withWildcards(func(hostname, zone string, ttl time.Duration) []libdns.Record {
+			return []libdns.Record{libdns.CNAME{Name: libdns.RelativeName(hostname, zone), TTL: ttl, Target: offline.Target}}
+		}, wildcards))
+
+		h.applyChangeLists(ctx, deletes, lock, BaseProvider.DeleteRecords, false, Good, results)
+		h.applyChangeLists(ctx, updates, lock, BaseProvider.SetRecords, true, Good, results)
+	default:
+		var deletes = h.makeChangeLists(hosts, zones, &results, func(hostname, zone string, ttl time.Duration) []libdns.Record {
+			return append(typeRecords("A", "AAAA")(hostname, zone, ttl), typeRecords("A", "AAAA")("*."+hostname, zone, ttl)...)
+		})
+
+		h.applyChangeLists(ctx, deletes, lock, BaseProvider.DeleteRecords, false, Good, results)
+	}
+
+	return nil
+}
+
+// clearOffline removes the CNAME records created by the "cname" offline
+// mode, so the address records can be set again. Only a CNAME to the
+// configured target is removed, and only when the host currently has it
+// (see deleteExistingRecords). For the other modes the address records
+// are just overwritten and nothing has to be removed.
+//
+// The returned hostnames had their *.<host> records taken offline by the
+// "cname" or "ip" mode, which should be set again with the address records
+// of the host. With the "delete" mode, the client has to set wildcard=ON.
+func (h *Handler) clearOffline(ctx context.Context, hosts []string, zones [][]string, results []ReturnCode) map[string]bool {
+
+	var wildcards = make(map[string]bool)
+
+	if nil == h.Offline || h.Offline.Mode == OfflineDelete {
+		return wildcards
+	}
+
+	var offline = h.Offline
+
+	for hostname, records := range h.wildcardRecords(ctx, hosts, zones, results) {
+		switch offline.Mode {
+		case OfflineCNAME:
+			wildcards[hostname] = slices.ContainsFunc(records, func(record libdns.RR) bool {
+				return record.Type == "CNAME" && offline.isTarget(record.Data)
+			})
+		case OfflineIP:
+			wildcards[hostname] = slices.ContainsFunc(records, func(record libdns.RR) bool {
+				return record.Type == "A" || record.Type == "AAAA"
+			}) && false == slices.ContainsFunc(records, func(record libdns.RR) bool {
+				ip, err := netip.ParseAddr(record.Data)
+				return (record.Type == "A" || record.Type == "AAAA") && (err != nil || false == slices.Contains(offline.addresses, ip.Unmap()))
+			})
+		}
+	}
+
+	if offline.Mode != OfflineCNAME {
+		return wildcards
+	}
+
+	// use a copy, so removing the CNAME does not mark the host as updated
+	// and the address records of the host are still set after this
+	var codes = make([]ReturnCode, len(results))
+
+	copy(codes, results)
+
+	var deletes = h.makeChangeLists(hosts, zones, &codes, withWildcards(func(hostname, zone string, ttl time.Duration) []libdns.Record {
+		return []libdns.Record{libdns.CNAME{Name: libdns.RelativeName(hostname, zone), TTL: ttl, Target: offline.Target}}
+	}, wildcards))
+
+	h.applyChangeLists(ctx, deletes, NewSemaphore(5), deleteExistingRecords, false, Good, codes)
+
+	for idx, code := range codes {
+		if code == DNSError || code == NoHost {
+			results[idx] = code
+		}
+	}
+
+	return wildcards
+}
+
+// isTarget checks if the CNAME target is the target of the "cname" mode.
+func (o *Offline) isTarget(target string) bool {
+	return strings.EqualFold(strings.TrimSuffix(target, "."), strings.TrimSuffix(o.Target, "."))
+}
+
+// wildcardRecords returns the current records of *.<host> by (normalized)
+// hostname for the hosts that are not resolved yet, where the records are
+// fetched once for every zone. Hosts without these records are left out.
+func (h *Handler) wildcardRecords(ctx context.Context, hosts []string, zones [][]string, results []ReturnCode) map[string][]libdns.RR {
+
+	var current = make(map[int]map[string][]libdns.Record)
+	var wildcards = make(map[string][]libdns.RR)
+
+	for idx, hostname := range hosts {
+
+		if results[idx] != NoChange {
+			continue
+		}
+
+		x, zone, ok := findZone(hostname, zones)
+
+		if false == ok {
+			continue
+		}
+
+		if _, ok := current[x]; !ok {
+			current[x] = make(map[string][]libdns.Record)
+		}
+
+		records, ok := current[x][zone]
+
+		if !ok {
+
+			var err error
+
+			if records, err = h.providers[x].GetRecords(ctx, zone); err != nil {
+				h.logger.Warn("could not fetch current records", zap.String("zone", zone), zap.Error(err))
+			}
+
+			current[x][zone] = records
+		}
+
+		var name = "*." + normalizeName(hostname)
+
+		for _, record := range records {
+			if normalizeName(libdns.AbsoluteName(record.RR().Name, zone)) == name {
+				wildcards[normalizeName(hostname)] = append(wildcards[normalizeName(hostname)], record.RR())
+			}
+		}
+	}
+
+	return wildcards
+}
+
+// withWildcards returns a function for makeChangeLists that also creates the
+// records for *.<host> of the given hostnames.
+func withWildcards(records func(hostname, zone string, ttl time.Duration) []libdns.Record, hostnames map[string]bool) func(hostname, zone string, ttl time.Duration) []libdns.Record {
+	return func(hostname, zone string, ttl time.Duration) []libdns.Record {
+
+		var result = records(hostname, zone, ttl)
+
+		if hostnames[hostname] {
+			result = append(result, records("*."+hostname, zone, ttl)...)
+		}
+
+		return result
+	}
+}
+
+// typeRecords returns a function for makeChangeLists that creates a record
+// without data for every type, which matches all records of that type
+// when deleting.
+func typeRecords(types ...string) func(hostname, zone string, ttl time.Duration) []libdns.Record {
+	return func(hostname, zone string, ttl time.Duration) []libdns.Record {
+
+		var records = make([]libdns.Record, len(types))
+
+		for idx, kind := range types {
+			records[idx] = libdns.RR{Name: libdns.RelativeName(hostname, zone), Type: kind}
+		}
+
+		return records
+	}
+}
+
+func hasAddressType(ips []netip.Addr, kind string) bool {
+
+	for _, ip := range ips {
+		if (kind == "A") == ip.Is4() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnmarshalCaddyfile sets up the offline config from Caddyfile tokens. Syntax:
+//
+//	offline delete
+//	offline ip <address>...
+//	offline cname <target>
+func (o *Offline) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+
+	o.Mode = d.Val()
+
+	switch o.Mode {
+	case OfflineDelete:
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	case OfflineIP:
+		o.Addresses = d.RemainingArgs()
+		if len(o.Addresses) == 0 {
+			return d.ArgErr()
+		}
+	case OfflineCNAME:
+		if !d.AllArgs(&o.Target) {
+			return d.ArgErr()
+		}
+	default:
+		return d.Errf("unrecognized offline mode '%s'", o.Mode)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package dyndns_handler
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+// lines returns the records of the provider as "name type data" lines.
+func (m *memoryProvider) lines() []string {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var lines = make([]string, 0, len(m.records))
+
+	for _, record := range m.records {
+		lines = append(lines, record.Name+" "+record.Type+" "+record.Data)
+	}
+
+	slices.Sort(lines)
+
+	return lines
+}
+
+func TestOfflineWildcard(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		offline *Offline
+		query   string
+		parked  []string
+		updated []string
+	}{
+		{
+			"delete",
+			nil,
+			"",
+			[]string{},
+			[]string{"nas A 198.51.100.2", "plain A 198.51.100.2"},
+		},
+		{
+			"ip",
+			&Offline{Mode: OfflineIP, Addresses: []string{"203.0.113.10"}},
+			"",
+			[]string{"*.nas A 203.0.113.10", "nas A 203.0.113.10", "plain A 203.0.113.10"},
+			[]string{"*.nas A 198.51.100.2", "nas A 198.51.100.2", "plain A 198.51.100.2"},
+		},
+		{
+			"cname",
+			&Offline{Mode: OfflineCNAME, Target: "maintenance.example.com"},
+			"",
+			[]string{"*.nas CNAME maintenance.example.com", "nas CNAME maintenance.example.com", "plain CNAME maintenance.example.com"},
+			[]string{"*.nas A 198.51.100.2", "nas A 198.51.100.2", "plain A 198.51.100.2"},
+		},
+		{
+			"cname wildcard off",
+			&Offline{Mode: OfflineCNAME, Target: "maintenance.example.com"},
+			"&wildcard=OFF",
+			[]string{"*.nas CNAME maintenance.example.com", "nas CNAME maintenance.example.com", "plain CNAME maintenance.example.com"},
+			[]string{"nas A 198.51.100.2", "plain A 198.51.100.2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			// only nas.example.com has wildcard records
+			var provider = &memoryProvider{zone: "example.com.", records: []libdns.RR{
+				{Name: "nas", Type: "A", Data: "198.51.100.1"},
+				{Name: "*.nas", Type: "A", Data: "198.51.100.1"},
+				{Name: "plain", Type: "A", Data: "198.51.100.1"},
+			}}
+
+			var handler = newTestHandler(t, nil, provider)
+
+			if nil != test.offline {
+
+				if err := test.offline.provision(); err != nil {
+					t.Fatal(err)
+				}
+
+				handler.Offline = test.offline
+			}
+
+			serveRequest(t, handler, "/nic/update?hostname=nas.example.com,plain.example.com&offline=YES", "", "")
+
+			if lines := provider.lines(); false == slices.Equal(lines, test.parked) {
+				t.Fatalf("expected %q after going offline, got %q", test.parked, lines)
+			}
+
+			serveRequest(t, handler, "/nic/update?hostname=nas.example.com,plain.example.com&myip=198.51.100.2"+test.query, "", "")
+
+			if lines := provider.lines(); false == slices.Equal(lines, test.updated) {
+				t.Fatalf("expected %q after the update, got %q", test.updated, lines)
+			}
+		})
+	}
+}
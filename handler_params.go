@@ -0,0 +1,119 @@
+package dyndns_handler
+
+import (
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// The optional dyndns2 update parameters, see
+// https://help.dyn.com/remote-access-api/perform-update/
+const (
+	ParamWildcard = "wildcard"
+	ParamMX       = "mx"
+	ParamBackMX   = "backmx"
+	ParamOffline  = "offline"
+)
+
+// usedParameters returns the optional parameters of the query that will
+// change something, so "NOCHG" values (and offline=NO) are not included.
+func usedParameters(query url.Values) []string {
+
+	var params = make([]string, 0)
+
+	for _, name := range []string{ParamWildcard, ParamMX, ParamBackMX} {
+		if query.Has(name) && false == strings.EqualFold(query.Get(name), "nochg") {
+			params = append(params, name)
+		}
+	}
+
+	for _, name := range []string{ParamTXT, ParamIPv6Prefix, ParamLanIP} {
+		if query.Has(name) {
+			params = append(params, name)
+		}
+	}
+
+	if isOffline(query.Get(ParamOffline)) {
+		params = append(params, ParamOffline)
+	}
+
+	return params
+}
+
+// checkParameters returns the first optional parameter of the
+// query the user is not allowed to use.
+func checkParameters(user *User, query url.Values) (string, bool) {
+
+	for _, name := range usedParameters(query) {
+		if false == user.AllowsParameter(name) {
+			return name, false
+		}
+	}
+
+	return "", true
+}
+
+// dynDNSRecords returns a function for makeChangeLists that creates the
+// address records for the host and, based on the wildcard and mx
+// parameters, the address records for *.<host> and the MX records. The
+// *.<host> records are also restored for the given hostnames of which
+// they were taken offline (see clearOffline), unless wildcard=OFF.
+func dynDNSRecords(query url.Values, ips func(hostname string) []netip.Addr, offline map[string]bool) func(hostname, zone string, ttl time.Duration) []libdns.Record {
+
+	var wildcard = strings.EqualFold(query.Get(ParamWildcard), "on")
+	var restore = false == strings.EqualFold(query.Get(ParamWildcard), "off")
+	var mx = strings.TrimSpace(query.Get(ParamMX))
+	var backup = strings.EqualFold(query.Get(ParamBackMX), "yes")
+
+	return func(hostname, zone string, ttl time.Duration) []libdns.Record {
+
+		var addresses = addressRecords(ips(hostname))
+		var records = addresses(hostname, zone, ttl)
+
+		if wildcard || (restore && offline[hostname]) {
+			records = append(records, addresses("*."+hostname, zone, ttl)...)
+		}
+
+		if mx != "" && false == strings.EqualFold(mx, "nochg") {
+
+			var name = libdns.RelativeName(hostname, zone)
+
+			// with backmx the given mx is a backup, so the host
+			// itself is listed with a lower preference value
+			if backup {
+				records = append(records, libdns.MX{Name: name, TTL: ttl, Preference: 5, Target: fqdn(hostname)})
+			}
+
+			records = append(records, libdns.MX{Name: name, TTL: ttl, Preference: 10, Target: fqdn(mx)})
+		}
+
+		return records
+	}
+}
+
+// dynDNSDeletes returns a function for makeChangeLists that creates the
+// records to remove, which are the *.<host> address records for
+// wildcard=OFF and the MX records when the mx parameter is empty.
+func dynDNSDeletes(query url.Values) func(hostname, zone string, ttl time.Duration) []libdns.Record {
+	return func(hostname, zone string, ttl time.Duration) []libdns.Record {
+
+		var records = make([]libdns.Record, 0)
+
+		if strings.EqualFold(query.Get(ParamWildcard), "off") {
+			records = append(records, typeRecords("A", "AAAA")("*."+hostname, zone, ttl)...)
+		}
+
+		if query.Has(ParamMX) && strings.TrimSpace(query.Get(ParamMX)) == "" {
+			records = append(records, typeRecords("MX")(hostname, zone, ttl)...)
+		}
+
+		return records
+	}
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
@@ -0,0 +1,148 @@
+package dyndns_handler
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// ParamIPv6Prefix holds the delegated IPv6 prefix from which the AAAA
+// records are derived for the hostnames with a configured suffix.
+const ParamIPv6Prefix = "myipv6prefix"
+
+// provisionIPv6Suffixes validates the configured suffixes and indexes
+// them by normalized hostname.
+func (h *Handler) provisionIPv6Suffixes() error {
+
+	h.ipv6Suffixes = make(map[string]netip.Addr, len(h.IPv6Suffixes))
+
+	for hostname, suffix := range h.IPv6Suffixes {
+
+		if false == suffix.Is6() || suffix.Is4In6() {
+			return fmt.Errorf("invalid IPv6 suffix %s for %s", suffix, hostname)
+		}
+
+		h.ipv6Suffixes[normalizeName(hostname)] = suffix
+	}
+
+	return nil
+}
+
+// getIPv6Prefix returns the prefix of the myipv6prefix parameter, or an
+// invalid prefix when not given. Prefixes longer than /64 are rejected, as
+// the suffixes are interface identifiers of the lower 64 bits.
+func getIPv6Prefix(query url.Values) (netip.Prefix, error) {
+
+	var value = strings.TrimSpace(query.Get(ParamIPv6Prefix))
+
+	if value == "" {
+		return netip.Prefix{}, nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	if false == prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("%s is not an IPv6 prefix", value)
+	}
+
+	if prefix.Bits() > 64 {
+		return netip.Prefix{}, fmt.Errorf("%s is longer than /64", value)
+	}
+
+	return prefix.Masked(), nil
+}
+
+// hostAddresses returns a function that gives the addresses for a hostname,
+// where the IPv6 address is replaced by the prefix combined with the suffix
+// of the hostname. Hostnames without suffix (or an invalid prefix) get the
+// given addresses.
+func (h *Handler) hostAddresses(prefix netip.Prefix, ips []netip.Addr) func(hostname string) []netip.Addr {
+	return func(hostname string) []netip.Addr {
+
+		derived, ok := h.derivedAddress(prefix, hostname)
+
+		if false == ok {
+			return ips
+		}
+
+		var addresses = make([]netip.Addr, 0, len(ips)+1)
+
+		for _, ip := range ips {
+			if ip.Is4() {
+				addresses = append(addresses, ip)
+			}
+		}
+
+		return append(addresses, derived)
+	}
+}
+
+// derivedAddress returns the address of the hostname derived from the prefix,
+// which is only available for hostnames with a suffix and a valid prefix.
+func (h *Handler) derivedAddress(prefix netip.Prefix, hostname string) (netip.Addr, bool) {
+
+	suffix, ok := h.ipv6Suffixes[normalizeName(hostname)]
+
+	if false == ok || false == prefix.IsValid() {
+		return netip.Addr{}, false
+	}
+
+	return combinePrefix(prefix, suffix), true
+}
+
+// combinePrefix returns the address with the network bits of
+// the prefix and the remaining (host) bits of the suffix.
+func combinePrefix(prefix netip.Prefix, suffix netip.Addr) netip.Addr {
+
+	var network, host = prefix.Masked().Addr().As16(), suffix.As16()
+
+	for i, c := 0, len(network); i < c; i++ {
+		var mask = byte(0xff << (8 - min(max(prefix.Bits()-i*8, 0), 8)))
+		network[i] = network[i]&mask | host[i]&^mask
+	}
+
+	return netip.AddrFrom16(network)
+}
+
+// unmarshalIPv6Suffixes sets the suffixes from Caddyfile tokens. Syntax:
+//
+//	ipv6_suffixes {
+//		<hostname> <suffix>
+//	}
+func (h *Handler) unmarshalIPv6Suffixes(d *caddyfile.Dispenser) error {
+
+	if nil == h.IPv6Suffixes {
+		h.IPv6Suffixes = make(map[string]netip.Addr)
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+
+		var hostname = d.Val()
+		var value string
+
+		if !d.AllArgs(&value) {
+			return d.ArgErr()
+		}
+
+		if _, x := h.IPv6Suffixes[hostname]; x {
+			return d.Errf("duplicate ipv6 suffix for %s", hostname)
+		}
+
+		suffix, err := netip.ParseAddr(value)
+
+		if err != nil {
+			return d.Errf("invalid ipv6 suffix '%s': %v", value, err)
+		}
+
+		h.IPv6Suffixes[hostname] = suffix
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package dyndns_handler
+
+import (
+	"net/netip"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestCombinePrefix(t *testing.T) {
+
+	var suffix = netip.MustParseAddr("::1:211:32ff:fe12:3456")
+
+	var tests = []struct {
+		prefix string
+		ip     string
+	}{
+		{"2001:db8:1200::/48", "2001:db8:1200:1:211:32ff:fe12:3456"},
+		{"2001:db8:1200:ab00::/56", "2001:db8:1200:ab01:211:32ff:fe12:3456"},
+		{"2001:db8:1200:abc0::/60", "2001:db8:1200:abc1:211:32ff:fe12:3456"},
+		{"2001:db8:1200:abcd::/64", "2001:db8:1200:abcd:211:32ff:fe12:3456"},
+	}
+
+	for _, test := range tests {
+		if ip := combinePrefix(netip.MustParsePrefix(test.prefix), suffix); ip.String() != test.ip {
+			t.Fatalf("expected %s for %s, got %s", test.ip, test.prefix, ip)
+		}
+	}
+}
+
+func TestGetIPv6Prefix(t *testing.T) {
+
+	var tests = []struct {
+		value  string
+		prefix string
+	}{
+		{"", "invalid Prefix"},
+		{"2001:db8:1200:ab12::/56", "2001:db8:1200:ab00::/56"},
+		{"2001:db8::/80", ""},
+		{"198.51.100.0/24", ""},
+		{"2001:db8::", ""},
+	}
+
+	for _, test := range tests {
+
+		prefix, err := getIPv6Prefix(url.Values{ParamIPv6Prefix: {test.value}})
+
+		if test.prefix == "" {
+			if err == nil {
+				t.Fatalf("expected an error for %s, got %s", test.value, prefix)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if prefix.String() != test.prefix {
+			t.Fatalf("expected %s for %q, got %s", test.prefix, test.value, prefix)
+		}
+	}
+}
+
+func TestHostAddresses(t *testing.T) {
+
+	var handler = &Handler{IPv6Suffixes: map[string]netip.Addr{"nas.example.com": netip.MustParseAddr("::10")}}
+
+	if err := handler.provisionIPv6Suffixes(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ips = []netip.Addr{netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("2001:db8::1")}
+	var prefix = netip.MustParsePrefix("2001:db8:1200::/48")
+
+	var tests = []struct {
+		hostname  string
+		prefix    netip.Prefix
+		addresses []netip.Addr
+	}{
+		{"nas.example.com", prefix, []netip.Addr{ips[0], netip.MustParseAddr("2001:db8:1200::10")}},
+		{"NAS.example.com.", prefix, []netip.Addr{ips[0], netip.MustParseAddr("2001:db8:1200::10")}},
+		{"router.example.com", prefix, ips},
+		{"nas.example.com", netip.Prefix{}, ips},
+	}
+
+	for _, test := range tests {
+		if addresses := handler.hostAddresses(test.prefix, ips)(test.hostname); false == slices.Equal(addresses, test.addresses) {
+			t.Fatalf("expected %v for %s, got %v", test.addresses, test.hostname, addresses)
+		}
+	}
+}
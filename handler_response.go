@@ -3,24 +3,57 @@ package dyndns_handler
 import (
 	"io"
 	"net/netip"
+	"strings"
 
-	"github.com/libdns/libdns"
 	"go.uber.org/zap"
 )
 
 type ReturnCode string
 
 // https://help.dyn.com/return-codes.html
+// https://www.noip.com/integrate/response
 const (
 	Good                        ReturnCode = "good"
 	NoChange                    ReturnCode = "nochg"
 	NotFullyQualifiedDomainName ReturnCode = "notfqdn"
 	DNSError                    ReturnCode = "dnserr"
 	NoHost                      ReturnCode = "nohost"
+	NumHost                     ReturnCode = "numhost"
 	BadAuthentication           ReturnCode = "badauth"
+	BadAgent                    ReturnCode = "badagent"
+	NotDonator                  ReturnCode = "!donator"
+	Abuse                       ReturnCode = "abuse"
+	ServerError                 ReturnCode = "911"
+
+	// BadIP is not part of the specifications and returned when the
+	// address is rejected by an ip policy or the IPv6 prefix is invalid.
+	BadIP ReturnCode = "badip"
 )
 
-func (h *Handler) writeReturnCode(writer io.Writer, ip *netip.Addr, hosts []string, codes ...ReturnCode) error {
+// maxHosts is the number of hostnames that can be updated with
+// a single request, more hostnames will return NumHost.
+const maxHosts = 20
+
+// noIPReturnCodes maps the return codes that are not supported by No-IP to
+// their No-IP equivalent, where good, nochg, nohost, badauth, badagent,
+// !donator, abuse and 911 are No-IP codes as well.
+var noIPReturnCodes = map[ReturnCode]ReturnCode{
+	NotFullyQualifiedDomainName: NoHost,
+	NumHost:                     NoHost,
+	DNSError:                    ServerError,
+	BadIP:                       NoHost,
+}
+
+// writeReturnCode writes a line for every code, where good and nochg are
+// followed by the addresses separated by a comma (like "good 1.2.3.4,2001:db8::1")
+func (h *Handler) writeReturnCode(writer io.Writer, ips []netip.Addr, hosts []string, codes ...ReturnCode) error {
+	return h.writeHostReturnCodes(writer, func(string) []netip.Addr { return ips }, hosts, codes...)
+}
+
+// writeHostReturnCodes is like writeReturnCode, but with the addresses
+// per hostname, like the AAAA records derived from an IPv6 prefix (see
+// Handler.hostAddresses).
+func (h *Handler) writeHostReturnCodes(writer io.Writer, addresses func(hostname string) []netip.Addr, hosts []string, codes ...ReturnCode) error {
 
 	var buf = make([]byte, 0)
 	var size = len(codes)
@@ -32,10 +65,23 @@ func (h *Handler) writeReturnCode(writer io.Writer, ip *netip.Addr, hosts []stri
 
 	for i, c := 0, size; i < c; i++ {
 
-		var value = string(codes[i])
+		var code = codes[i]
 
-		if (codes[i] == Good || codes[i] == NoChange) && ip != nil {
-			value += " " + ip.String()
+		if h.Protocol == ProtocolNoIP {
+			if x, ok := noIPReturnCodes[code]; ok {
+				code = x
+			}
+		}
+
+		var value = string(code)
+		var hostname string
+
+		if len(hosts) == size {
+			hostname = hosts[i]
+		}
+
+		if ips := addresses(hostname); (code == Good || code == NoChange) && len(ips) > 0 {
+			value += " " + joinAddresses(ips)
 		}
 
 		buf = append(buf, value...)
@@ -68,10 +114,24 @@ func (h *Handler) setReturnCodes(result []ReturnCode, value ReturnCode) []Return
 	return result
 }
 
-func (h *Handler) setReturnCodesForItems(result *[]ReturnCode, items []libdns.Record, value ReturnCode, zone string, hosts []string) {
-	for _, item := range items {
-		if x := getHostIdx(hosts, item.RR().Name, zone); x != -1 {
-			(*result)[x] = value
+// setReturnCodesForHosts sets the code for the given hosts, where hosts
+// that already failed keep the DNSError code, so changes that are applied
+// in multiple steps will still report the failure.
+func setReturnCodesForHosts(result []ReturnCode, hosts []int, value ReturnCode) {
+	for _, idx := range hosts {
+		if result[idx] != DNSError {
+			result[idx] = value
 		}
 	}
 }
+
+func joinAddresses(ips []netip.Addr) string {
+
+	var values = make([]string, len(ips))
+
+	for idx, ip := range ips {
+		values[idx] = ip.String()
+	}
+
+	return strings.Join(values, ",")
+}
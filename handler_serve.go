@@ -5,190 +5,182 @@ import (
 	"fmt"
 	"net/http"
 	"net/netip"
-	"net/url"
+	"slices"
 	"strings"
-	"time"
 
-	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/libdns/libdns"
 	"go.uber.org/zap"
 )
 
-// ServeHTTP will handle incoming request and return 200 with code as described in
-//
-//	https://help.dyn.com/return-codes.html
+// ServeHTTP will handle incoming request and dispatch it to
+// the handler of the configured protocol.
 func (h *Handler) ServeHTTP(response http.ResponseWriter, request *http.Request, next caddyhttp.Handler) error {
 
 	h.logger.Debug(
-		fmt.Sprintf("%s %s", request.Method, request.RequestURI),
+		fmt.Sprintf("%s %s", request.Method, h.redactedURI(request)),
 	)
 
-	if false == h.authorize(request) {
-		return h.writeReturnCode(response, nil, nil, BadAuthentication)
+	switch h.Protocol {
+	case ProtocolDuckDNS:
+		return h.serveDuckDNS(response, request)
+	default:
+		return h.serveDynDNS(response, request)
 	}
+}
+
+// redactedURI returns the request uri with the value of the token
+// parameter replaced, so the tokens do not end up in the logs.
+func (h *Handler) redactedURI(request *http.Request) string {
 
 	var query = request.URL.Query()
 
-	if false == query.Has("hostname") {
-		// If no hostnames were specified, **notfqdn** will be returned once.
-		return h.writeReturnCode(response, nil, nil, NotFullyQualifiedDomainName)
+	if h.TokenParam == "" || false == query.Has(h.TokenParam) {
+		return request.RequestURI
 	}
 
-	var ip netip.Addr
-	var err error
-	var hosts, results = getHosts(query)
-	var lock = NewSemaphore(5)
-
-	if ip, err = getIp(query, request.RemoteAddr, request.Header, h); err != nil {
-		if x := h.writeReturnCode(response, nil, hosts, h.setReturnCodes(results, DNSError)...); x != nil {
-			return errors.Join(err, x)
-		}
-		return err
+	for idx := range query[h.TokenParam] {
+		query[h.TokenParam][idx] = "REDACTED"
 	}
 
-	h.logger.Info(
-		"ddns update request",
-		zap.String("ip", ip.String()),
-		zap.Strings("hosts", hosts),
-		zap.String("user agent", request.Header.Get("user-agent")),
-	)
-
-	var zones = getAvailableZones(request.Context(), h.providers, lock, h.logger)
-
-	type job struct {
-		provider BaseProvider
-		items    map[string][]libdns.Record
-		result   map[string][]libdns.Record
-		errors   map[string]error
-	}
-
-	var queue = make([]*job, 0)
-
-	for idx, items := range h.makeChangeLists(hosts, ip, zones, &results) {
-
-		lock.Lock()
-
-		var work = &job{
-			provider: h.providers[idx],
-			items:    items,
-			result:   make(map[string][]libdns.Record),
-			errors:   make(map[string]error),
-		}
+	var uri = *request.URL
 
-		queue = append(queue, work)
+	uri.RawQuery = query.Encode()
 
-		go func(job *job) {
-			defer lock.Unlock()
-			for zone, records := range items {
-				job.result[zone], job.errors[zone] = job.provider.SetRecords(request.Context(), zone, records)
-			}
+	return uri.RequestURI()
+}
 
-		}(work)
+// serveDynDNS will handle incoming request and return 200 with code as described in
+//
+//	https://help.dyn.com/return-codes.html
+//	https://www.noip.com/integrate/response
+//
+// which are almost the same, except that No-IP requires a user agent and
+// does not know all return codes (see noIPReturnCodes).
+func (h *Handler) serveDynDNS(response http.ResponseWriter, request *http.Request) error {
+
+	// https://www.noip.com/integrate/request
+	if h.Protocol == ProtocolNoIP && strings.TrimSpace(request.Header.Get("user-agent")) == "" {
+		h.logger.Debug("request without user agent")
+		return h.writeReturnCode(response, nil, nil, BadAgent)
 	}
 
-	lock.Wait()
+	user, code := h.authenticate(request)
 
-	for i, c := 0, len(queue); i < c; i++ {
-		for zone, records := range queue[i].items {
-			if queue[i].errors[zone] != nil {
-				h.logger.Error("setting records failed", zap.String("zone", zone), zap.Error(queue[i].errors[zone]))
-				h.setReturnCodesForItems(&results, records, DNSError, zone, hosts)
-			} else if len(queue[i].result[zone]) > 0 {
-				h.setReturnCodesForItems(&results, records, Good, zone, hosts)
-			}
-		}
+	if code != "" {
+		return h.writeReturnCode(response, nil, nil, code)
 	}
 
-	return h.writeReturnCode(response, &ip, hosts, results...)
-}
-
-func (h *Handler) authorize(request *http.Request) bool {
+	var query = request.URL.Query()
 
-	if len(h.Users) == 0 {
-		h.logger.Debug("authorisation ok, no user configured")
-		return true
+	if false == query.Has("hostname") {
+		// If no hostnames were specified, **notfqdn** will be returned once.
+		return h.writeReturnCode(response, nil, nil, NotFullyQualifiedDomainName)
 	}
 
-	user, passwd, ok := request.BasicAuth()
+	var ips []netip.Addr
+	var err error
+	var hosts, results = getHosts(query.Get("hostname"))
+	var lock = NewSemaphore(5)
 
-	if !ok {
-		h.logger.Debug("authorisation failed, no or invalid authorization header")
-		return false
+	if len(hosts) > maxHosts {
+		h.logger.Warn(fmt.Sprintf("too many hostnames, got %d where the maximum is %d", len(hosts), maxHosts))
+		return h.writeReturnCode(response, nil, nil, NumHost)
 	}
 
-	if v, ok := h.Users[user]; !ok || v != passwd {
-		h.logger.Debug("authorisation failed, user not exists or password invalid")
-		return false
+	if name, ok := checkParameters(user, query); !ok {
+		h.logger.Warn(fmt.Sprintf("parameter %s not allowed for user", name))
+		return h.writeReturnCode(response, nil, hosts, h.setReturnCodes(results, NotDonator)...)
 	}
 
-	h.logger.Debug("authorisation ok")
-	return true
-}
+	h.checkHostPermissions(user, hosts, results)
 
-func getHosts(query url.Values) ([]string, []ReturnCode) {
-	var hosts = strings.Split(query.Get("hostname"), ",")
-	var results = make([]ReturnCode, len(hosts))
+	// the internal providers are only updated with
+	// the LAN address, see updateInternal
+	var all = h.zones.Get(request.Context())
+	var zones = h.viewZones(all, ViewPublic)
 
-	for idx, _ := range hosts {
-		results[idx] = NoChange
+	if query.Has(ParamTXT) {
+		h.logger.Info("ddns txt request", zap.Strings("hosts", hosts))
+		h.setChallenges(request.Context(), query, hosts, zones, results)
+		return h.writeReturnCode(response, nil, hosts, results...)
 	}
 
-	return hosts, results
-}
+	if isOffline(query.Get(ParamOffline)) {
 
-func getHostIdx(hosts []string, name string, zone string) int {
+		h.logger.Info("ddns offline request", zap.Strings("hosts", hosts))
 
-	var hostname = strings.TrimSuffix(libdns.AbsoluteName(name, zone), ".")
+		var internal = slices.Clone(results)
+		var parking = h.setOffline(request.Context(), hosts, zones, results)
 
-	for i, c := 0, len(hosts); i < c; i++ {
-		if hostname == hosts[i] {
-			return i
+		if h.hasView(ViewInternal) {
+			h.setOffline(request.Context(), hosts, h.viewZones(all, ViewInternal), internal)
+			mergeViewResults(results, internal)
 		}
+
+		return h.writeReturnCode(response, parking, hosts, results...)
 	}
 
-	return -1
-}
+	prefix, err := getIPv6Prefix(query)
 
-func (h *Handler) makeChangeLists(hosts []string, ip netip.Addr, zones [][]string, result *[]ReturnCode) map[int]map[string][]libdns.Record {
+	// an invalid prefix is an error of the client, so it is not returned
+	if err != nil {
+		h.logger.Warn("invalid ipv6 prefix", zap.String("prefix", query.Get(ParamIPv6Prefix)), zap.Error(err))
+		return h.writeReturnCode(response, nil, hosts, h.setReturnCodes(results, BadIP)...)
+	}
 
-	var updates = make(map[int]map[string][]libdns.Record)
+	if ips, err = getAddresses(query, request, h); err != nil {
+		if x := h.writeReturnCode(response, nil, hosts, h.setReturnCodes(results, DNSError)...); x != nil {
+			return errors.Join(err, x)
+		}
+		return err
+	}
 
-hostnames:
-	for idx, hostname := range hosts {
+	h.logger.Info(
+		"ddns update request",
+		zap.Stringers("ips", ips),
+		zap.Strings("hosts", hosts),
+		zap.String("user agent", request.Header.Get("user-agent")),
+	)
 
-		for x, plugin := range h.providers {
+	var addresses = h.hostAddresses(prefix, ips)
 
-			for _, zone := range zones[x] {
-				if strings.HasSuffix(hostname, "."+zone) {
+	h.checkIPPolicies(request, user, hosts, addresses, prefix, ViewPublic, results)
 
-					h.logger.Debug(fmt.Sprintf("hostname %s matches zone %s (module %s)", hostname, zone, ProviderName(plugin.(caddy.Module))))
+	// after the policy check, so a rejected host is not updated at all
+	var internal = slices.Clone(results)
 
-					if _, ok := updates[x]; !ok {
-						updates[x] = make(map[string][]libdns.Record)
-					}
+	var offline = h.clearOffline(request.Context(), hosts, zones, results)
+	var deletes = h.makeChangeLists(hosts, zones, &results, dynDNSDeletes(query))
+	var updates = h.makeChangeLists(hosts, zones, &results, dynDNSRecords(query, addresses, offline))
 
-					if _, ok := updates[x][zone]; !ok {
-						updates[x][zone] = make([]libdns.Record, 0)
-					}
+	h.applyChangeLists(request.Context(), deletes, lock, BaseProvider.DeleteRecords, false, Good, results)
+	h.applyChangeLists(request.Context(), updates, lock, BaseProvider.SetRecords, true, Good, results)
 
-					updates[x][zone] = append(updates[x][zone], libdns.Address{
-						Name: libdns.RelativeName(hostname, zone),
-						TTL:  (time.Minute * 5).Round(time.Second),
-						IP:   ip,
-					})
+	if h.hasView(ViewInternal) {
+		h.updateInternal(request, query, user, hosts, all, internal)
+		mergeViewResults(results, internal)
+	}
 
-					continue hostnames
-				}
-			}
+	return h.writeHostReturnCodes(response, addresses, hosts, results...)
+}
 
-			h.logger.Debug(fmt.Sprintf("hostname %s is not supported by module %s", hostname, ProviderName(plugin.(caddy.Module))), zap.Strings("zones", zones[x]))
+// checkHostPermissions marks the hosts the user is not allowed to update with NoHost.
+func (h *Handler) checkHostPermissions(user *User, hosts []string, results []ReturnCode) {
+	for idx, hostname := range hosts {
+		if false == user.Allows(hostname) {
+			h.logger.Warn(fmt.Sprintf("hostname %s not allowed for user", hostname))
+			results[idx] = NoHost
 		}
+	}
+}
 
-		h.logger.Warn(fmt.Sprintf("hostname %s not supported by providers", hostname))
+func getHosts(value string) ([]string, []ReturnCode) {
+	var hosts = strings.Split(value, ",")
+	var results = make([]ReturnCode, len(hosts))
 
-		(*result)[idx] = NoHost
+	for idx, _ := range hosts {
+		results[idx] = NoChange
 	}
 
-	return updates
+	return hosts, results
 }
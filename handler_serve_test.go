@@ -0,0 +1,117 @@
+package dyndns_handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// newTestHandler returns a handler for the given users (with
+// plain passwords) that updates the records of the providers.
+func newTestHandler(t *testing.T, users map[string]*User, providers ...Provider) *Handler {
+
+	var ctx, cancel = caddy.NewContext(caddy.Context{Context: context.Background()})
+	var logger = zap.NewNop()
+
+	t.Cleanup(cancel)
+
+	for _, user := range users {
+		if err := user.provision(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Handler{
+		Users:        users,
+		providers:    providers,
+		zones:        newZoneCache(ctx, providers, time.Minute, logger),
+		logger:       logger,
+		fakePassword: make([]byte, sha256.Size),
+		fileUsers:    new(atomic.Pointer[map[string]*User]),
+	}
+}
+
+// serveRequest sends a request with the given basic auth credentials
+// from 192.0.2.10 to the handler and returns the response body.
+func serveRequest(t *testing.T, h *Handler, target, name, passwd string) string {
+
+	var recorder = httptest.NewRecorder()
+	var request = httptest.NewRequest("GET", target, nil)
+
+	request.RemoteAddr = "192.0.2.10:5000"
+	request.SetBasicAuth(name, passwd)
+
+	if err := h.ServeHTTP(recorder, request, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return recorder.Body.String()
+}
+
+func TestServeHostPermissions(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com."}
+	var handler = newTestHandler(t, map[string]*User{"foo": {Password: "bar", Hosts: []string{"*.home.example.com"}}}, provider)
+	var body = serveRequest(t, handler, "/nic/update?hostname=a.home.example.com,other.example.com,b.home.example.com&myip=198.51.100.1", "foo", "bar")
+
+	if expected := "good 198.51.100.1\nnohost\ngood 198.51.100.1"; body != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+
+	var tests = []struct {
+		name  string
+		count int
+	}{
+		{"a.home", 1},
+		{"other", 0},
+		{"b.home", 1},
+	}
+
+	for _, test := range tests {
+		if count := provider.count(test.name, "A"); count != test.count {
+			t.Fatalf("expected %d A records for %s, got %d", test.count, test.name, count)
+		}
+	}
+}
+
+func TestRedactedURI(t *testing.T) {
+
+	var handler = &Handler{TokenParam: "token"}
+
+	var tests = []struct {
+		uri      string
+		redacted string
+	}{
+		{"/update?domains=foo&token=secret", "/update?domains=foo&token=REDACTED"},
+		{"/update?domains=foo", "/update?domains=foo"},
+	}
+
+	for _, test := range tests {
+		if uri := handler.redactedURI(httptest.NewRequest("GET", test.uri, nil)); uri != test.redacted {
+			t.Fatalf("expected %s, got %s", test.redacted, uri)
+		}
+	}
+}
+
+func TestServeInvalidIPv6Prefix(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com."}
+	var handler = newTestHandler(t, map[string]*User{"foo": {Password: "bar"}}, provider)
+
+	// serveRequest fails the test when an error is returned
+	var body = serveRequest(t, handler, "/nic/update?hostname=a.example.com,b.example.com&myip=198.51.100.1&myipv6prefix=2001:db8::/80", "foo", "bar")
+
+	if expected := "badip\nbadip"; body != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+
+	if count := provider.count("a", "A"); count != 0 {
+		t.Fatalf("expected no records, got %d", count)
+	}
+}
@@ -0,0 +1,317 @@
+package dyndns_handler
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+// defaultTTL is the TTL used for the created records when not configured
+const defaultTTL = time.Minute * 5
+
+// changeSet holds the records per provider (index) and zone
+// that should be changed for the requested hosts.
+type changeSet map[int]map[string]*changes
+
+// changes holds the records for a zone, together with the
+// index of the requested host every record belongs to.
+type changes struct {
+	records []libdns.Record
+	hosts   []int
+}
+
+func (c *changes) add(host int, records ...libdns.Record) {
+	for _, record := range records {
+		c.records = append(c.records, record)
+		c.hosts = append(c.hosts, host)
+	}
+}
+
+// without returns the changes without the records of which the RRset (all
+// records with the same name and type) is already equal to the current records.
+func (c *changes) without(current []libdns.Record, zone string) *changes {
+
+	var key = func(record libdns.RR) string {
+		return strings.ToLower(strings.TrimSuffix(libdns.AbsoluteName(record.Name, zone), ".")) + "/" + record.Type
+	}
+
+	var existing = make(map[string][]libdns.RR)
+	var wanted = make(map[string][]libdns.RR)
+
+	for _, record := range current {
+		existing[key(record.RR())] = append(existing[key(record.RR())], record.RR())
+	}
+
+	for _, record := range c.records {
+		wanted[key(record.RR())] = append(wanted[key(record.RR())], record.RR())
+	}
+
+	var result = new(changes)
+
+	for idx, record := range c.records {
+		if false == equalRecordSets(wanted[key(record.RR())], existing[key(record.RR())]) {
+			result.add(c.hosts[idx], record)
+		}
+	}
+
+	return result
+}
+
+// equalRecordSets checks if both sets hold the same records, where
+// the TTL is only compared when known by both records.
+func equalRecordSets(a, b []libdns.RR) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+records:
+	for _, x := range a {
+		for _, y := range b {
+			if x.Type == y.Type && equalRecordData(x, y) && (x.TTL == 0 || y.TTL == 0 || x.TTL == y.TTL) {
+				continue records
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func equalRecordData(a, b libdns.RR) bool {
+
+	switch a.Type {
+	case "A", "AAAA":
+		x, err1 := netip.ParseAddr(a.Data)
+		y, err2 := netip.ParseAddr(b.Data)
+		return err1 == nil && err2 == nil && x.Unmap() == y.Unmap()
+	case "TXT":
+		return a.Data == b.Data
+	default:
+		return strings.EqualFold(strings.TrimSuffix(a.Data, "."), strings.TrimSuffix(b.Data, "."))
+	}
+}
+
+// operation is the provider method which will be called with
+// the changes, like BaseProvider.SetRecords
+type operation func(provider BaseProvider, ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error)
+
+// appendMissingRecords is an operation that only appends the records that
+// do not exist yet, so presenting the same record twice will not create
+// a duplicate (or fail with providers that reject duplicates).
+func appendMissingRecords(provider BaseProvider, ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+
+	current, err := provider.GetRecords(ctx, zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var missing = make([]libdns.Record, 0)
+
+records:
+	for _, record := range records {
+
+		var x = record.RR()
+
+		// also compare against the missing records, as multiple
+		// hosts can share a record (like example.com and *.example.com)
+		for _, existing := range append(current, missing...) {
+
+			var y = existing.RR()
+
+			if x.Type == y.Type && strings.EqualFold(libdns.AbsoluteName(x.Name, zone), libdns.AbsoluteName(y.Name, zone)) && equalRecordData(x, y) {
+				continue records
+			}
+		}
+
+		missing = append(missing, record)
+	}
+
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	return provider.AppendRecords(ctx, zone, missing)
+}
+
+// deleteExistingRecords is an operation that only deletes the records that
+// exist, where the current records are passed to the provider, so nothing
+// is written when none of the records exist.
+func deleteExistingRecords(provider BaseProvider, ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+
+	current, err := provider.GetRecords(ctx, zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var existing = make([]libdns.Record, 0)
+
+	for _, record := range current {
+
+		var x = record.RR()
+
+		for _, remove := range records {
+
+			var y = remove.RR()
+
+			if x.Type == y.Type && strings.EqualFold(libdns.AbsoluteName(x.Name, zone), libdns.AbsoluteName(y.Name, zone)) && equalRecordData(x, y) {
+				existing = append(existing, record)
+				break
+			}
+		}
+	}
+
+	if len(existing) == 0 {
+		return nil, nil
+	}
+
+	return provider.DeleteRecords(ctx, zone, existing)
+}
+
+// makeChangeLists will find the provider and zone for every host (see
+// findZone) and groups the records created by the given function with
+// the configured TTL. Hosts that are not supported by any provider are
+// marked with NoHost.
+func (h *Handler) makeChangeLists(hosts []string, zones [][]string, result *[]ReturnCode, records func(hostname, zone string, ttl time.Duration) []libdns.Record) changeSet {
+
+	var updates = make(changeSet)
+
+	for idx, hostname := range hosts {
+
+		// already resolved, for example because
+		// the user is not allowed to update it
+		if (*result)[idx] != NoChange {
+			continue
+		}
+
+		x, zone, ok := findZone(hostname, zones)
+
+		if false == ok {
+			h.logger.Warn(fmt.Sprintf("hostname %s not supported by providers", hostname))
+			(*result)[idx] = NoHost
+			continue
+		}
+
+		h.logger.Debug(fmt.Sprintf("hostname %s matches zone %s (module %s)", hostname, zone, ProviderName(h.providers[x].(caddy.Module))))
+
+		if _, ok := updates[x]; !ok {
+			updates[x] = make(map[string]*changes)
+		}
+
+		if _, ok := updates[x][zone]; !ok {
+			updates[x][zone] = new(changes)
+		}
+
+		var name = normalizeName(hostname)
+		var ttl = h.TTL.get(name, zone)
+
+		if limiter, ok := h.providers[x].(ttlLimiter); ok {
+			ttl = limiter.limitTTL(ttl)
+		}
+
+		updates[x][zone].add(idx, records(name, normalizeName(zone), ttl)...)
+	}
+
+	return updates
+}
+
+// applyChangeLists calls the operation concurrently for every provider and zone
+// in the change set. The hosts of a zone are marked with DNSError when failed,
+// or with the given code when the provider returned the changed records.
+//
+// When skipUnchanged is true, the current records are fetched first and the
+// records that already match are not passed to the operation, so those hosts
+// keep their NoChange code and no needless writes are done.
+func (h *Handler) applyChangeLists(ctx context.Context, updates changeSet, lock WaitableLocker, op operation, skipUnchanged bool, code ReturnCode, result []ReturnCode) {
+
+	type job struct {
+		provider BaseProvider
+		items    map[string]*changes
+		result   map[string][]libdns.Record
+		errors   map[string]error
+	}
+
+	var queue = make([]*job, 0)
+
+	for idx, items := range updates {
+
+		lock.Lock()
+
+		var work = &job{
+			provider: h.providers[idx],
+			items:    items,
+			result:   make(map[string][]libdns.Record),
+			errors:   make(map[string]error),
+		}
+
+		queue = append(queue, work)
+
+		go func(job *job) {
+			defer lock.Unlock()
+			for zone, changes := range job.items {
+
+				if skipUnchanged {
+
+					current, err := job.provider.GetRecords(ctx, zone)
+
+					if err != nil {
+						h.logger.Warn("could not fetch current records", zap.String("zone", zone), zap.Error(err))
+					} else {
+						changes = changes.without(current, zone)
+						job.items[zone] = changes
+					}
+				}
+
+				if len(changes.records) == 0 {
+					h.logger.Debug("records unchanged", zap.String("zone", zone))
+					continue
+				}
+
+				job.result[zone], job.errors[zone] = op(job.provider, ctx, zone, changes.records)
+			}
+
+		}(work)
+	}
+
+	lock.Wait()
+
+	for i, c := 0, len(queue); i < c; i++ {
+		for zone, changes := range queue[i].items {
+			if queue[i].errors[zone] != nil {
+				h.logger.Error("changing records failed", zap.String("zone", zone), zap.Error(queue[i].errors[zone]))
+				setReturnCodesForHosts(result, changes.hosts, DNSError)
+			} else if len(queue[i].result[zone]) > 0 {
+				setReturnCodesForHosts(result, changes.hosts, code)
+			}
+		}
+	}
+}
+
+// addressRecords returns a function for makeChangeLists that creates an
+// address record for every given ip. Because SetRecords only replaces the
+// records with the same name and type, updating the A record will leave
+// the AAAA record untouched and the other way around.
+func addressRecords(ips []netip.Addr) func(hostname, zone string, ttl time.Duration) []libdns.Record {
+	return func(hostname, zone string, ttl time.Duration) []libdns.Record {
+
+		var records = make([]libdns.Record, len(ips))
+
+		for idx, ip := range ips {
+			records[idx] = libdns.Address{
+				Name: libdns.RelativeName(hostname, zone),
+				TTL:  ttl,
+				IP:   ip,
+			}
+		}
+
+		return records
+	}
+}
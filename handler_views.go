@@ -0,0 +1,141 @@
+package dyndns_handler
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// The views a provider can be tagged with (see OptionsProvider), so the
+// public providers get the WAN address and the internal providers (like
+// a local RFC 2136 server) the LAN address of the client.
+const (
+	ViewPublic   = "public"
+	ViewInternal = "internal"
+)
+
+// ParamLanIP holds the LAN addresses (IPv4 and IPv6 separated by a
+// comma) for the internal providers, when omitted the address of
+// the client is used.
+const ParamLanIP = "mylanip"
+
+// viewer is implemented by providers that are tagged with a view, where
+// all other providers are public.
+type viewer interface {
+	view() string
+}
+
+func providerView(provider Provider) string {
+
+	if x, ok := provider.(viewer); ok {
+		return x.view()
+	}
+
+	return ViewPublic
+}
+
+// hasView checks if one of the providers is tagged with the view.
+func (h *Handler) hasView(view string) bool {
+
+	for _, provider := range h.providers {
+		if providerView(provider) == view {
+			return true
+		}
+	}
+
+	return false
+}
+
+// viewZones returns the zones of the providers of the view, where the zones
+// of the other providers are left empty, so the index still matches the
+// provider.
+func (h *Handler) viewZones(zones [][]string, view string) [][]string {
+
+	var result = make([][]string, len(zones))
+
+	for idx := range zones {
+		if idx < len(h.providers) && providerView(h.providers[idx]) == view {
+			result[idx] = zones[idx]
+		}
+	}
+
+	return result
+}
+
+// getLanAddresses returns the addresses of the mylanip parameter or else
+// the address of the client, without resolving the public address for
+// local addresses.
+func getLanAddresses(query url.Values, request *http.Request, config *Handler) ([]netip.Addr, error) {
+
+	if ips := parseAddresses(strings.Split(query.Get(ParamLanIP), ",")...); len(ips) > 0 {
+		return ips, nil
+	}
+
+	ip, err := getClientIp(request, config, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []netip.Addr{ip}, nil
+}
+
+// updateInternal updates the hosts within the zones of the internal providers
+// with the LAN addresses, where the results should hold the codes from before
+// the public update. The LAN addresses are checked with the ip policies as
+// well, and the returned codes are merged with the public codes by
+// mergeViewResults.
+func (h *Handler) updateInternal(request *http.Request, query url.Values, user *User, hosts []string, zones [][]string, results []ReturnCode) {
+
+	zones = h.viewZones(zones, ViewInternal)
+
+	ips, err := getLanAddresses(query, request, h)
+
+	if err != nil {
+		h.logger.Error("could not determine lan ip", zap.Error(err))
+
+		for idx, hostname := range hosts {
+			if _, _, ok := findZone(hostname, zones); ok && results[idx] == NoChange {
+				results[idx] = DNSError
+			}
+		}
+
+		return
+	}
+
+	h.logger.Info("ddns internal update request", zap.Stringers("ips", ips), zap.Strings("hosts", hosts))
+
+	var addresses = func(string) []netip.Addr { return ips }
+
+	h.checkIPPolicies(request, user, hosts, addresses, netip.Prefix{}, ViewInternal, results)
+
+	var offline = h.clearOffline(request.Context(), hosts, zones, results)
+	var lock = NewSemaphore(5)
+	var deletes = h.makeChangeLists(hosts, zones, &results, dynDNSDeletes(query))
+	var updates = h.makeChangeLists(hosts, zones, &results, dynDNSRecords(query, addresses, offline))
+
+	h.applyChangeLists(request.Context(), deletes, lock, BaseProvider.DeleteRecords, false, Good, results)
+	h.applyChangeLists(request.Context(), updates, lock, BaseProvider.SetRecords, true, Good, results)
+}
+
+// mergeViewResults merges the codes of the internal update into the codes
+// of the public update, where nohost of one view (the hostname is not
+// within its zones) is replaced by the code of the other view and an
+// error of either view is kept.
+func mergeViewResults(public, internal []ReturnCode) {
+
+	for idx, code := range internal {
+		switch {
+		case code == NoHost:
+		case public[idx] == NoHost:
+			public[idx] = code
+		case public[idx] == Good || public[idx] == NoChange:
+			if code != NoChange {
+				public[idx] = code
+			}
+		}
+	}
+}
@@ -2,29 +2,37 @@ package dyndns_handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
 )
 
-func getAvailableZones(ctx context.Context, providers []Provider, lock WaitableLocker, logger *zap.Logger) [][]string {
+// getAvailableZones fetches the zones of all providers concurrently, where
+// the zones and errors are returned in the same order as the providers.
+func getAvailableZones(ctx context.Context, providers []Provider, lock WaitableLocker, logger *zap.Logger) ([][]string, []error) {
 
 	type job struct {
-		idx      *int
+		idx      int
 		zones    *[]string
+		err      *error
 		provider Provider
 	}
 
 	var zones = make([][]string, len(providers))
+	var errs = make([]error, len(providers))
 	var work = make([]*job, len(providers))
 
 	for i, c := 0, len(providers); i < c; i++ {
 		zones[i] = make([]string, 0)
 		work[i] = &job{
-			idx:      &i,
+			idx:      i,
 			zones:    &zones[i],
+			err:      &errs[i],
 			provider: providers[i],
 		}
 	}
@@ -42,8 +50,9 @@ func getAvailableZones(ctx context.Context, providers []Provider, lock WaitableL
 				logger.Error(
 					fmt.Sprintf("could not fetch zones: %s", err.Error()),
 					zap.String("module", ProviderName(x.provider.(caddy.Module))),
-					zap.Int("module idx", *x.idx),
+					zap.Int("module idx", x.idx),
 				)
+				*x.err = err
 				return
 			}
 
@@ -56,5 +65,200 @@ func getAvailableZones(ctx context.Context, providers []Provider, lock WaitableL
 
 	lock.Wait()
 
+	return zones, errs
+}
+
+// normalizeName returns the name in lower case without trailing dot.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// findZone returns the provider (index) and zone with the longest suffix
+// of the hostname, so "a.home.example.com" will match "home.example.com"
+// before "example.com". A hostname also matches its own zone (the apex).
+// When multiple providers have the same zone, the first one is used.
+func findZone(hostname string, zones [][]string) (int, string, bool) {
+
+	var name = normalizeName(hostname)
+	var provider, match = -1, ""
+
+	for idx, items := range zones {
+		for _, zone := range items {
+
+			var normalized = normalizeName(zone)
+
+			if normalized == "" || len(normalized) <= len(normalizeName(match)) {
+				continue
+			}
+
+			if name == normalized || strings.HasSuffix(name, "."+normalized) {
+				provider, match = idx, zone
+			}
+		}
+	}
+
+	return provider, match, provider >= 0
+}
+
+// zoneRetryDelay is the delay before a provider that never loaded is
+// retried on a request, which is doubled on every failure up to the ttl.
+const zoneRetryDelay = 10 * time.Second
+
+// zoneCache holds the zones of the providers, so they don't have to be
+// fetched on every request. The zones are refreshed in the background,
+// and when fetching fails for a provider, the last good list is kept.
+type zoneCache struct {
+	providers []Provider
+	ttl       time.Duration
+	zones     [][]string
+	loaded    []bool
+	failures  []int
+	retryAt   []time.Time
+	mu        sync.RWMutex
+	logger    *zap.Logger
+}
+
+// zoneCaches holds all active caches, so they can be
+// refreshed with the admin api (see adminAPI).
+var zoneCaches = struct {
+	sync.Mutex
+	items map[*zoneCache]struct{}
+}{
+	items: make(map[*zoneCache]struct{}),
+}
+
+// newZoneCache creates a cache for the providers and does the first load,
+// which will log errors so bad credentials are reported at startup. The
+// cache is refreshed every ttl until the context is done.
+func newZoneCache(ctx caddy.Context, providers []Provider, ttl time.Duration, logger *zap.Logger) *zoneCache {
+
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+
+	var cache = &zoneCache{
+		providers: providers,
+		ttl:       ttl,
+		zones:     make([][]string, len(providers)),
+		loaded:    make([]bool, len(providers)),
+		failures:  make([]int, len(providers)),
+		retryAt:   make([]time.Time, len(providers)),
+		logger:    logger,
+	}
+
+	for i := range cache.zones {
+		cache.zones[i] = make([]string, 0)
+	}
+
+	if err := cache.refresh(ctx, false); err != nil {
+		logger.Error("could not load zones of all providers", zap.Error(err))
+	}
+
+	zoneCaches.Lock()
+	zoneCaches.items[cache] = struct{}{}
+	zoneCaches.Unlock()
+
+	go cache.run(ctx)
+
+	return cache
+}
+
+func (z *zoneCache) run(ctx caddy.Context) {
+
+	var ticker = time.NewTicker(z.ttl)
+
+	defer func() {
+		ticker.Stop()
+		zoneCaches.Lock()
+		delete(zoneCaches.items, z)
+		zoneCaches.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := z.refresh(ctx, false); err != nil {
+			z.logger.Warn("refreshing zones failed, using last known zones", zap.Error(err))
+		}
+	}
+}
+
+// refresh fetches the zones of the providers and replaces the
+// cached zones of the providers that succeeded. When onlyMissing
+// is true, only the providers that never loaded are fetched, and
+// only when their retry delay (see zoneRetryDelay) has passed.
+func (z *zoneCache) refresh(ctx context.Context, onlyMissing bool) error {
+
+	var providers = make([]Provider, 0)
+	var indexes = make([]int, 0)
+	var now = time.Now()
+
+	z.mu.Lock()
+
+	for idx, provider := range z.providers {
+
+		if onlyMissing && (z.loaded[idx] || now.Before(z.retryAt[idx])) {
+			continue
+		}
+
+		// reserve the retry as if this attempt fails, so
+		// concurrent requests will not fetch it again
+		z.retryAt[idx] = now.Add(z.retryDelay(z.failures[idx] + 1))
+
+		providers = append(providers, provider)
+		indexes = append(indexes, idx)
+	}
+
+	z.mu.Unlock()
+
+	if len(providers) == 0 {
+		return nil
+	}
+
+	zones, errs := getAvailableZones(ctx, providers, NewSemaphore(5), z.logger)
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for i, idx := range indexes {
+		if errs[i] == nil {
+			z.zones[idx] = zones[i]
+			z.loaded[idx] = true
+			z.failures[idx] = 0
+		} else {
+			z.failures[idx]++
+			z.retryAt[idx] = time.Now().Add(z.retryDelay(z.failures[idx]))
+			errs[i] = fmt.Errorf("%s: %w", ProviderName(providers[i].(caddy.Module)), errs[i])
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// retryDelay returns the delay after the given number of failures.
+func (z *zoneCache) retryDelay(failures int) time.Duration {
+	return min(zoneRetryDelay<<min(failures-1, 16), z.ttl)
+}
+
+// Get returns the zones of all providers, where the providers that never
+// loaded successfully (like failing at startup) are retried first, with
+// a backoff so a failing provider is not called on every request.
+func (z *zoneCache) Get(ctx context.Context) [][]string {
+
+	if err := z.refresh(ctx, true); err != nil {
+		z.logger.Warn("loading zones failed", zap.Error(err))
+	}
+
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var zones = make([][]string, len(z.zones))
+
+	copy(zones, z.zones)
+
 	return zones
 }
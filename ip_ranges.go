@@ -0,0 +1,129 @@
+package dyndns_handler
+
+import (
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// specialPurposeRanges holds the ranges of the IANA special-purpose address
+// registries that are not globally reachable, see:
+//
+//	https://www.iana.org/assignments/iana-ipv4-special-registry
+//	https://www.iana.org/assignments/iana-ipv6-special-registry
+//
+// IPv4-mapped IPv6 addresses are unmapped before they are checked, so
+// ::ffff:0:0/96 is not listed. Multicast is added, as it never belongs
+// to a client.
+var specialPurposeRanges = IPPrefixList{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private-use
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space (CGNAT)
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private-use
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation (TEST-NET-1)
+	netip.MustParsePrefix("192.88.99.0/24"),  // deprecated 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private-use
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation (TEST-NET-2)
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation (TEST-NET-3)
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, including broadcast
+	netip.MustParsePrefix("::/128"),          // unspecified
+	netip.MustParsePrefix("::1/128"),         // loopback
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use IPv4/IPv6 translation
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("3fff::/20"),       // documentation
+	netip.MustParsePrefix("5f00::/16"),       // segment routing (SRv6) SIDs
+	netip.MustParsePrefix("fc00::/7"),        // unique-local
+	netip.MustParsePrefix("fe80::/10"),       // link-local unicast
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// LocalRanges decides which addresses are considered local (not public)
+// for no_local_ip. By default, these are the special-purpose ranges,
+// which can be extended or reduced.
+type LocalRanges struct {
+
+	// Additional ranges that are considered local
+	Add IPPrefixList `json:"add,omitempty"`
+
+	// Ranges that are considered public, even when they
+	// are part of a special-purpose (or added) range.
+	Remove IPPrefixList `json:"remove,omitempty"`
+}
+
+// Contains reports whether the address is local, where a nil
+// LocalRanges only checks the special-purpose ranges.
+func (r *LocalRanges) Contains(ip netip.Addr) bool {
+
+	ip = ip.Unmap()
+
+	if nil == r {
+		return specialPurposeRanges.Contains(ip)
+	}
+
+	if r.Remove.Contains(ip) {
+		return false
+	}
+
+	return specialPurposeRanges.Contains(ip) || r.Add.Contains(ip)
+}
+
+// UnmarshalCaddyfile sets up the local ranges from Caddyfile tokens,
+// where the inline prefixes are added. Syntax:
+//
+//	local_ranges [<ip prefix>...] {
+//		add <ip prefix>...
+//		remove <ip prefix>...
+//	}
+func (r *LocalRanges) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if err := parsePrefixes(d, d.RemainingArgs(), &r.Add); err != nil {
+		return err
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "add":
+			if err := parsePrefixes(d, d.RemainingArgs(), &r.Add); err != nil {
+				return err
+			}
+		case "remove":
+			if err := parsePrefixes(d, d.RemainingArgs(), &r.Remove); err != nil {
+				return err
+			}
+		default:
+			return d.Errf("unrecognized local_ranges option '%s'", d.Val())
+		}
+	}
+
+	if len(r.Add) == 0 && len(r.Remove) == 0 {
+		return d.Errf("must specify at least one ip prefix")
+	}
+
+	return nil
+}
+
+func parsePrefixes(d *caddyfile.Dispenser, args []string, list *IPPrefixList) error {
+
+	for i, c := 0, len(args); i < c; i++ {
+		prefix, err := netip.ParsePrefix(args[i])
+
+		if err != nil {
+			return d.Errf("invalid ip prefix '%s': %v", args[i], err)
+		}
+
+		*list = append(*list, prefix.Masked())
+	}
+
+	return nil
+}
+
+var (
+	_ caddyfile.Unmarshaler = (*LocalRanges)(nil)
+)
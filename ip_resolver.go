@@ -1,14 +1,13 @@
 package dyndns_handler
 
 import (
-	"context"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
 	"strings"
-	"sync"
-	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
 type IPPrefixList []netip.Prefix
@@ -22,94 +21,149 @@ func (t *IPPrefixList) Contains(ip netip.Addr) bool {
 	return false
 }
 
-// getIp first checks if an IP address is provided in the request query.
-// If it’s omitted or cannot be parsed, it attempts to determine the
-// client’s IP address by processing the X-Forwarded-For header.
-// If no valid IP is found (or the header is missing), it will either
-// return the remote address from the connection or attempt to retrieve
-// the WAN address depending on config (NoLocalIp).
-func getIp(query url.Values, remoteAddr string, header http.Header, config *Handler) (netip.Addr, error) {
+// clientIP returns the client ip as determined by caddy (which respects
+// the trusted_proxies of the server), or else the remote address.
+func clientIP(request *http.Request) string {
+
+	var ip, _ = caddyhttp.GetVar(request.Context(), caddyhttp.ClientIPVarKey).(string)
+
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(request.RemoteAddr)
+	}
+
+	return ip
+}
+
+// getAddresses first checks if IP addresses are provided in the request
+// query, where myip can hold an IPv4 and IPv6 address separated by a
+// comma (as sent by inadyn and ddclient) and myipv6 an IPv6 address.
+// If omitted or none can be parsed, it falls back to getIp.
+func getAddresses(query url.Values, request *http.Request, config *Handler) ([]netip.Addr, error) {
 
 	// https://help.dyn.com/perform-update.html
-	if query.Has("myip") {
-		if value, err := netip.ParseAddr(query.Get("myip")); err == nil {
-			return value, nil
-		}
+	if ips := parseAddresses(append(strings.Split(query.Get("myip"), ","), query.Get("myipv6"))...); len(ips) > 0 {
+		return ips, nil
 	}
 
-	remote, err := netip.ParseAddrPort(remoteAddr)
+	ip, err := getIp(request, config)
 
 	if err != nil {
-		return netip.Addr{}, err
+		return nil, err
 	}
 
-	var locals = sync.OnceValue(func() *IPPrefixList {
-		var locals IPPrefixList = make([]netip.Prefix, 5)
+	return []netip.Addr{ip}, nil
+}
+
+// parseAddresses returns the first valid IPv4 and IPv6 address
+// of the given values, ignoring the values that cannot be parsed.
+func parseAddresses(values ...string) []netip.Addr {
 
-		// see https://datatracker.ietf.org/doc/html/rfc1918
+	var ips = make([]netip.Addr, 0, 2)
+	var v4, v6 bool
 
-		for idx, x := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.1/8", "fd00::/8"} {
-			if prefix, _ := netip.ParsePrefix(x); prefix.IsValid() {
-				locals[idx] = prefix
-			}
+	for _, value := range values {
+
+		ip, err := netip.ParseAddr(strings.TrimSpace(value))
+
+		if err != nil {
+			continue
+		}
+
+		ip = ip.Unmap()
+
+		if ip.Is4() && false == v4 {
+			ips, v4 = append(ips, ip), true
+		}
+
+		if ip.Is6() && false == v6 {
+			ips, v6 = append(ips, ip), true
 		}
+	}
+
+	return ips
+}
 
-		return &locals
-	})
+// getIp attempts to determine the client’s IP address. The remote address
+// is the one of the connection, or the client ip resolved by caddy (see
+// the trusted_proxies of the server) when UseClientIP is set. For trusted
+// remotes the forwarded header is walked from right to left, and the first
+// address that is not trusted is used. If no valid IP is found (or the
+// header is missing), it will either return the remote address or attempt
+// to retrieve the WAN address depending on config (NoLocalIp).
+func getIp(request *http.Request, config *Handler) (netip.Addr, error) {
+	return getClientIp(request, config, nil != config && config.NoLocalIp)
+}
 
-	if nil == config || nil == config.TrustedRemotes || false == config.TrustedRemotes.Contains(remote.Addr()) {
+// getClientIp does the work for getIp, where noLocalIp is passed so
+// the LAN address of the client can be determined as well.
+func getClientIp(request *http.Request, config *Handler, noLocalIp bool) (netip.Addr, error) {
 
-		if nil != config && config.NoLocalIp && locals().Contains(remote.Addr()) {
-			return getRemoteIp()
+	remote, err := getRemoteIp(request, config)
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if nil == config || nil == config.TrustedRemotes || false == config.TrustedRemotes.Contains(remote) {
+
+		if noLocalIp && config.LocalRanges.Contains(remote) {
+			return config.PublicIP.Resolve(request.Context(), "ip")
 		}
 
-		return remote.Addr(), nil
+		return remote, nil
 	}
 
-	var list = getIpAddrFromList(header.Values("x-forwarded-for"))
+	var list = getForwardedIps(request.Header, config.ForwardedHeader)
 
 	for i := len(list) - 1; i >= 0; i-- {
-		if list[i].IsValid() && false == config.TrustedRemotes.Contains(list[i]) && (config.NoLocalIp && false == locals().Contains(list[i])) {
+		if list[i].IsValid() && false == config.TrustedRemotes.Contains(list[i]) && (false == noLocalIp || false == config.LocalRanges.Contains(list[i])) {
 			return list[i], nil
 		}
 	}
 
-	if config.NoLocalIp {
-		return getRemoteIp()
+	if noLocalIp {
+		return config.PublicIP.Resolve(request.Context(), "ip")
 	}
 
-	return remote.Addr(), nil
+	return remote, nil
 }
 
-// getRemoteIp will do dns query to get remote ip similar
-// to the command
-//
-//	dig +short @resolver1.opendns.com myip.opendns.com
-func getRemoteIp() (netip.Addr, error) {
+// getRemoteIp returns the address of the connection, or the client ip
+// resolved by caddy when configured.
+func getRemoteIp(request *http.Request, config *Handler) (netip.Addr, error) {
 
-	var resolver = &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+	if nil != config && config.UseClientIP {
+		ip, err := netip.ParseAddr(clientIP(request))
 
-			var dialer = net.Dialer{
-				Timeout: time.Millisecond * time.Duration(10000),
-			}
+		if err != nil {
+			return netip.Addr{}, err
+		}
 
-			return dialer.DialContext(ctx, network, "resolver1.opendns.com:53")
-		},
+		return ip.Unmap(), nil
 	}
 
-	ip, err := resolver.LookupHost(context.Background(), "myip.opendns.com")
+	remote, err := netip.ParseAddrPort(request.RemoteAddr)
 
 	if err != nil {
 		return netip.Addr{}, err
 	}
 
-	if len(ip) == 0 {
-		return netip.Addr{}, nil
-	}
+	return remote.Addr().Unmap(), nil
+}
 
-	return netip.ParseAddr(ip[0])
+// getForwardedIps returns the addresses of the given header, where the
+// Forwarded header is parsed as specified by RFC 7239 and any other
+// header (X-Forwarded-For when empty) as a comma separated list.
+func getForwardedIps(header http.Header, name string) []netip.Addr {
+
+	switch http.CanonicalHeaderKey(name) {
+	case "":
+		return getIpAddrFromList(header.Values("x-forwarded-for"))
+	case "Forwarded":
+		return getIpAddrFromForwarded(header.Values("forwarded"))
+	default:
+		return getIpAddrFromList(header.Values(name))
+	}
 }
 
 func getIpAddrFromList(list []string) []netip.Addr {
@@ -127,7 +181,53 @@ func getIpAddrFromList(list []string) []netip.Addr {
 		for x, y := 0, len(values); x < y; x++ {
 			// ignore error for now and check later with IsValid
 			item, _ := netip.ParseAddr(strings.TrimSpace(values[x]))
-			items = append(items, item)
+			items = append(items, item.Unmap())
+		}
+	}
+
+	return items
+}
+
+// getIpAddrFromForwarded returns the "for" addresses of the Forwarded
+// headers, like:
+//
+//	Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+//
+// Unknown and obfuscated identifiers are returned as invalid address
+// so they are skipped, see https://datatracker.ietf.org/doc/html/rfc7239
+func getIpAddrFromForwarded(list []string) []netip.Addr {
+
+	if 0 == len(list) {
+		return nil
+	}
+
+	var items = make([]netip.Addr, 0)
+
+	for i, c := 0, len(list); i < c; i++ {
+
+		for _, element := range strings.Split(list[i], ",") {
+
+			var item netip.Addr
+
+			for _, pair := range strings.Split(element, ";") {
+
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+
+				if false == ok || false == strings.EqualFold(key, "for") {
+					continue
+				}
+
+				value = strings.Trim(value, `"`)
+
+				if port, err := netip.ParseAddrPort(value); err == nil {
+					item = port.Addr()
+				} else {
+					// ignore error for now and check later with IsValid
+					item, _ = netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+				}
+			}
+
+			items = append(items, item.Unmap())
 		}
 	}
 
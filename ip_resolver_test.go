@@ -0,0 +1,57 @@
+package dyndns_handler
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestGetIp(t *testing.T) {
+
+	var trusted = &IPPrefixList{netip.MustParsePrefix("127.0.0.0/8")}
+
+	var tests = []struct {
+		name   string
+		config *Handler
+		remote string
+		header [2]string
+		ip     string
+	}{
+		{"remote", &Handler{}, "192.0.2.10:5000", [2]string{"X-Forwarded-For", "198.51.100.1"}, "192.0.2.10"},
+		{"untrusted remote", &Handler{TrustedRemotes: trusted}, "192.0.2.10:5000", [2]string{"X-Forwarded-For", "198.51.100.1"}, "192.0.2.10"},
+		{"trusted remote", &Handler{TrustedRemotes: trusted}, "127.0.0.1:5000", [2]string{"X-Forwarded-For", "198.51.100.1, 127.0.0.2"}, "198.51.100.1"},
+		{"trusted remote without header", &Handler{TrustedRemotes: trusted}, "127.0.0.1:5000", [2]string{}, "127.0.0.1"},
+		{"forwarded", &Handler{TrustedRemotes: trusted, ForwardedHeader: "Forwarded"}, "127.0.0.1:5000", [2]string{"Forwarded", `for="[2001:db8::17]:4711"`}, "2001:db8::17"},
+		{"custom header", &Handler{TrustedRemotes: trusted, ForwardedHeader: "CF-Connecting-IP"}, "127.0.0.1:5000", [2]string{"CF-Connecting-IP", "198.51.100.2"}, "198.51.100.2"},
+		{"client ip", &Handler{UseClientIP: true}, "127.0.0.1:5000", [2]string{}, "198.51.100.3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var request = httptest.NewRequest("GET", "/nic/update", nil)
+
+			request.RemoteAddr = test.remote
+
+			if test.header[0] != "" {
+				request.Header.Set(test.header[0], test.header[1])
+			}
+
+			// as set by caddy, after checking the trusted_proxies of the server
+			request = request.WithContext(context.WithValue(request.Context(), caddyhttp.VarsCtxKey, map[string]any{caddyhttp.ClientIPVarKey: "198.51.100.3"}))
+
+			ip, err := getIp(request, test.config)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ip.String() != test.ip {
+				t.Fatalf("expected %s, got %s", test.ip, ip)
+			}
+		})
+	}
+}
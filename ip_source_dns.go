@@ -0,0 +1,177 @@
+package dyndns_handler
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+)
+
+// DNSSource resolves the public address with a DNS query to a server that
+// answers with the address of the client, like myip.opendns.com. With
+// record type TXT, the address is read from a TXT record instead (like
+// o-o.myaddr.l.google.com with server ns1.google.com).
+type DNSSource struct {
+
+	// The DNS server to query. Default: resolver1.opendns.com:53
+	Server string `json:"server,omitempty"`
+
+	// The name to query. Default: myip.opendns.com
+	Name string `json:"name,omitempty"`
+
+	// The record type to query, which can be "A" (default, which will
+	// query AAAA for IPv6) or "TXT".
+	Type string `json:"type,omitempty"`
+
+	// The timeout of the query. Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+func init() {
+	caddy.RegisterModule(DNSSource{})
+}
+
+func (DNSSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ddns.ip_sources.dns",
+		New: func() caddy.Module { return new(DNSSource) },
+	}
+}
+
+func (s *DNSSource) GetIP(ctx context.Context, network string) (netip.Addr, error) {
+
+	var server, name = s.Server, s.Name
+	var client = &dns.Client{Net: "udp4"}
+	var qtype = dns.TypeA
+
+	if server == "" {
+		server = "resolver1.opendns.com:53"
+	}
+
+	if name == "" {
+		name = "myip.opendns.com"
+	}
+
+	if network == "ip6" {
+		client.Net, qtype = "udp6", dns.TypeAAAA
+	}
+
+	if strings.EqualFold(s.Type, "TXT") {
+		qtype = dns.TypeTXT
+	}
+
+	ctx, cancel := sourceContext(ctx, s.Timeout)
+
+	defer cancel()
+
+	var msg = new(dns.Msg)
+
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	response, _, err := client.ExchangeContext(ctx, msg, server)
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if response.Rcode != dns.RcodeSuccess {
+		return netip.Addr{}, fmt.Errorf("query for %s failed with %s", name, dns.RcodeToString[response.Rcode])
+	}
+
+	for _, rr := range response.Answer {
+		switch x := rr.(type) {
+		case *dns.A:
+			return netip.ParseAddr(x.A.String())
+		case *dns.AAAA:
+			return netip.ParseAddr(x.AAAA.String())
+		case *dns.TXT:
+			if len(x.Txt) > 0 {
+				return netip.ParseAddr(strings.TrimSpace(x.Txt[0]))
+			}
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("no address in answer for %s", name)
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens. Syntax:
+//
+//	dns [<server> [<name> [<type>]]] {
+//		server <server>
+//		name <name>
+//		type A|TXT
+//		timeout <duration>
+//	}
+func (s *DNSSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.Next() {
+		return d.ArgErr()
+	}
+
+	for idx, arg := range d.RemainingArgs() {
+		switch idx {
+		case 0:
+			s.Server = arg
+		case 1:
+			s.Name = arg
+		case 2:
+			s.Type = arg
+		default:
+			return d.ArgErr()
+		}
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "server":
+			if !d.AllArgs(&s.Server) {
+				return d.ArgErr()
+			}
+		case "name":
+			if !d.AllArgs(&s.Name) {
+				return d.ArgErr()
+			}
+		case "type":
+			if !d.AllArgs(&s.Type) {
+				return d.ArgErr()
+			}
+		case "timeout":
+			timeout, err := parseSourceTimeout(d)
+			if err != nil {
+				return err
+			}
+			s.Timeout = timeout
+		default:
+			return d.Errf("unrecognized dns source option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// parseSourceTimeout parses the argument of the timeout option of a source.
+func parseSourceTimeout(d *caddyfile.Dispenser) (caddy.Duration, error) {
+
+	var value string
+
+	if !d.AllArgs(&value) {
+		return 0, d.ArgErr()
+	}
+
+	timeout, err := caddy.ParseDuration(value)
+
+	if err != nil {
+		return 0, d.Errf("invalid timeout: %v", err)
+	}
+
+	return caddy.Duration(timeout), nil
+}
+
+var (
+	_ IPSource              = (*DNSSource)(nil)
+	_ caddyfile.Unmarshaler = (*DNSSource)(nil)
+)
@@ -0,0 +1,198 @@
+package dyndns_handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// HTTPSource resolves the public address with an echo service that returns
+// the address of the client, like https://api64.ipify.org. The connection
+// is made over IPv4 or IPv6, so services that support both can be used for
+// both addresses.
+type HTTPSource struct {
+
+	// The URL of the service. Default: https://api64.ipify.org
+	URL string `json:"url,omitempty"`
+
+	// When set, the response is decoded as JSON and the address
+	// is read from this (dot separated) path, like "ip".
+	JSONPath string `json:"json_path,omitempty"`
+
+	// The timeout of the request. Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// a client per network, as the connection
+	// is made over either IPv4 or IPv6
+	clients map[string]*http.Client
+}
+
+func init() {
+	caddy.RegisterModule(HTTPSource{})
+}
+
+func (HTTPSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ddns.ip_sources.http",
+		New: func() caddy.Module { return new(HTTPSource) },
+	}
+}
+
+func (s *HTTPSource) Provision(caddy.Context) error {
+
+	s.clients = make(map[string]*http.Client, 2)
+
+	for _, network := range []string{"ip4", "ip6"} {
+
+		var dial = "tcp" + strings.TrimPrefix(network, "ip")
+
+		s.clients[network] = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+					return new(net.Dialer).DialContext(ctx, dial, address)
+				},
+				IdleConnTimeout: time.Minute,
+			},
+		}
+	}
+
+	return nil
+}
+
+// Cleanup closes the idle connections of the clients.
+func (s *HTTPSource) Cleanup() error {
+
+	for _, client := range s.clients {
+		client.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+func (s *HTTPSource) GetIP(ctx context.Context, network string) (netip.Addr, error) {
+
+	var url = s.URL
+
+	if url == "" {
+		url = "https://api64.ipify.org"
+	}
+
+	client, ok := s.clients[network]
+
+	if false == ok {
+		return netip.Addr{}, fmt.Errorf("unsupported network %s", network)
+	}
+
+	ctx, cancel := sourceContext(ctx, s.Timeout)
+
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	response, err := client.Do(request)
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<16))
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if s.JSONPath == "" {
+		return netip.ParseAddr(strings.TrimSpace(string(body)))
+	}
+
+	var value any
+
+	if err := json.Unmarshal(body, &value); err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, key := range strings.Split(s.JSONPath, ".") {
+		if object, ok := value.(map[string]any); ok {
+			value = object[key]
+		} else {
+			value = nil
+		}
+	}
+
+	if address, ok := value.(string); ok {
+		return netip.ParseAddr(strings.TrimSpace(address))
+	}
+
+	return netip.Addr{}, fmt.Errorf("no address found at %s", s.JSONPath)
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens. Syntax:
+//
+//	http [<url>] {
+//		url <url>
+//		json_path <path>
+//		timeout <duration>
+//	}
+func (s *HTTPSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.Next() {
+		return d.ArgErr()
+	}
+
+	if d.NextArg() {
+		s.URL = d.Val()
+	}
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "url":
+			if !d.AllArgs(&s.URL) {
+				return d.ArgErr()
+			}
+		case "json_path":
+			if !d.AllArgs(&s.JSONPath) {
+				return d.ArgErr()
+			}
+		case "timeout":
+			timeout, err := parseSourceTimeout(d)
+			if err != nil {
+				return err
+			}
+			s.Timeout = timeout
+		default:
+			return d.Errf("unrecognized http source option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ IPSource              = (*HTTPSource)(nil)
+	_ caddy.Provisioner     = (*HTTPSource)(nil)
+	_ caddy.CleanerUpper    = (*HTTPSource)(nil)
+	_ caddyfile.Unmarshaler = (*HTTPSource)(nil)
+)
@@ -0,0 +1,87 @@
+package dyndns_handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// InterfaceSource uses the address of a local network interface, for
+// when caddy runs on the machine that holds the public address (like
+// the router with the pppoe interface). Addresses of special-purpose
+// ranges (like private and link local) are skipped.
+type InterfaceSource struct {
+
+	// The name of the interface, like eth0 or pppoe0
+	Name string `json:"name,omitempty"`
+}
+
+func init() {
+	caddy.RegisterModule(InterfaceSource{})
+}
+
+func (InterfaceSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ddns.ip_sources.interface",
+		New: func() caddy.Module { return new(InterfaceSource) },
+	}
+}
+
+func (s *InterfaceSource) GetIP(_ context.Context, network string) (netip.Addr, error) {
+
+	iface, err := net.InterfaceByName(s.Name)
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addresses, err := iface.Addrs()
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	for _, address := range addresses {
+
+		prefix, err := netip.ParsePrefix(address.String())
+
+		if err != nil {
+			continue
+		}
+
+		var ip = prefix.Addr().Unmap()
+
+		if (network == "ip4") != ip.Is4() || specialPurposeRanges.Contains(ip) {
+			continue
+		}
+
+		return ip, nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("no public %s address on interface %s", network, s.Name)
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens. Syntax:
+//
+//	interface <name>
+func (s *InterfaceSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.Next() {
+		return d.ArgErr()
+	}
+
+	if !d.AllArgs(&s.Name) {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
+var (
+	_ IPSource              = (*InterfaceSource)(nil)
+	_ caddyfile.Unmarshaler = (*InterfaceSource)(nil)
+)
@@ -0,0 +1,247 @@
+package dyndns_handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// STUNSource resolves the public address with a STUN binding request,
+// see https://datatracker.ietf.org/doc/html/rfc5389
+type STUNSource struct {
+
+	// The STUN server. Default: stun.l.google.com:19302
+	Server string `json:"server,omitempty"`
+
+	// The timeout of the request. Default: 10s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+const (
+	stunMagicCookie         = 0x2112A442
+	stunBindingRequest      = 0x0001
+	stunBindingResponse     = 0x0101
+	stunMappedAddress       = 0x0001
+	stunXorMappedAddress    = 0x0020
+	stunRetransmitInterval  = time.Millisecond * 500
+	stunHeaderSize          = 20
+	stunAttributeHeaderSize = 4
+)
+
+func init() {
+	caddy.RegisterModule(STUNSource{})
+}
+
+func (STUNSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ddns.ip_sources.stun",
+		New: func() caddy.Module { return new(STUNSource) },
+	}
+}
+
+func (s *STUNSource) GetIP(ctx context.Context, network string) (netip.Addr, error) {
+
+	var server = s.Server
+
+	if server == "" {
+		server = "stun.l.google.com:19302"
+	}
+
+	ctx, cancel := sourceContext(ctx, s.Timeout)
+
+	defer cancel()
+
+	conn, err := new(net.Dialer).DialContext(ctx, "udp"+strings.TrimPrefix(network, "ip"), server)
+
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	defer conn.Close()
+
+	var request = make([]byte, stunHeaderSize)
+
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+
+	if _, err := rand.Read(request[8:20]); err != nil {
+		return netip.Addr{}, err
+	}
+
+	var buf = make([]byte, 1500)
+
+	// the request is sent again on every interval, as udp packets can get lost
+	for {
+
+		if _, err := conn.Write(request); err != nil {
+			return netip.Addr{}, err
+		}
+
+		var deadline = time.Now().Add(stunRetransmitInterval)
+
+		if x, ok := ctx.Deadline(); ok && x.Before(deadline) {
+			deadline = x
+		}
+
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return netip.Addr{}, err
+		}
+
+		size, err := conn.Read(buf)
+
+		if err == nil {
+			return parseSTUNResponse(buf[:size], request[8:20])
+		}
+
+		if false == errors.Is(err, os.ErrDeadlineExceeded) {
+			return netip.Addr{}, err
+		}
+
+		if ctx.Err() != nil {
+			return netip.Addr{}, ctx.Err()
+		}
+	}
+}
+
+// parseSTUNResponse returns the (xor) mapped address of a binding response.
+func parseSTUNResponse(message []byte, transaction []byte) (netip.Addr, error) {
+
+	if len(message) < stunHeaderSize || binary.BigEndian.Uint16(message[0:]) != stunBindingResponse {
+		return netip.Addr{}, fmt.Errorf("invalid binding response")
+	}
+
+	if binary.BigEndian.Uint32(message[4:]) != stunMagicCookie || false == bytes.Equal(message[8:20], transaction) {
+		return netip.Addr{}, fmt.Errorf("binding response does not match request")
+	}
+
+	var attributes = message[stunHeaderSize:]
+	var mapped netip.Addr
+
+	if size := int(binary.BigEndian.Uint16(message[2:])); size <= len(attributes) {
+		attributes = attributes[:size]
+	}
+
+	for len(attributes) >= stunAttributeHeaderSize {
+
+		var kind = binary.BigEndian.Uint16(attributes[0:])
+		var size = int(binary.BigEndian.Uint16(attributes[2:]))
+
+		if len(attributes) < stunAttributeHeaderSize+size {
+			break
+		}
+
+		var value = attributes[stunAttributeHeaderSize : stunAttributeHeaderSize+size]
+
+		switch kind {
+		case stunXorMappedAddress:
+			if ip, ok := parseSTUNAddress(value, message[4:20]); ok {
+				return ip, nil
+			}
+		case stunMappedAddress:
+			if ip, ok := parseSTUNAddress(value, nil); ok {
+				mapped = ip
+			}
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		var next = stunAttributeHeaderSize + (size+3)&^3
+
+		if next > len(attributes) {
+			break
+		}
+
+		attributes = attributes[next:]
+	}
+
+	if mapped.IsValid() {
+		return mapped, nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("no mapped address in binding response")
+}
+
+// parseSTUNAddress parses the value of a (xor) mapped address attribute,
+// where the address is xor'ed with the magic cookie and transaction id
+// when given.
+func parseSTUNAddress(value []byte, xor []byte) (netip.Addr, bool) {
+
+	if len(value) < 4 {
+		return netip.Addr{}, false
+	}
+
+	var size = 4
+
+	if value[1] == 0x02 {
+		size = 16
+	}
+
+	if len(value) < 4+size {
+		return netip.Addr{}, false
+	}
+
+	var address = make([]byte, size)
+
+	copy(address, value[4:4+size])
+
+	for i := 0; i < size && nil != xor; i++ {
+		address[i] ^= xor[i]
+	}
+
+	return netip.AddrFromSlice(address)
+}
+
+// UnmarshalCaddyfile sets up the source from Caddyfile tokens. Syntax:
+//
+//	stun [<server>] {
+//		server <server>
+//		timeout <duration>
+//	}
+func (s *STUNSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.Next() {
+		return d.ArgErr()
+	}
+
+	if d.NextArg() {
+		s.Server = d.Val()
+	}
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "server":
+			if !d.AllArgs(&s.Server) {
+				return d.ArgErr()
+			}
+		case "timeout":
+			timeout, err := parseSourceTimeout(d)
+			if err != nil {
+				return err
+			}
+			s.Timeout = timeout
+		default:
+			return d.Errf("unrecognized stun source option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ IPSource              = (*STUNSource)(nil)
+	_ caddyfile.Unmarshaler = (*STUNSource)(nil)
+)
@@ -0,0 +1,237 @@
+package dyndns_handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// IPSource is implemented by the ddns.ip_sources.* modules, which resolve
+// the public address of this server for the network "ip4" or "ip6".
+type IPSource interface {
+	GetIP(ctx context.Context, network string) (netip.Addr, error)
+}
+
+const (
+	PolicyFirst  = "first"
+	PolicyQuorum = "quorum"
+)
+
+// defaultIPSourceTimeout is used for sources without a configured timeout
+const defaultIPSourceTimeout = time.Second * 10
+
+// PublicIP resolves the public address of this server with the configured
+// sources. When no sources are configured, myip.opendns.com is resolved
+// with resolver1.opendns.com.
+type PublicIP struct {
+
+	// The sources used to resolve the public address
+	SourcesRaw []json.RawMessage `json:"sources,omitempty" caddy:"namespace=ddns.ip_sources inline_key=source"`
+
+	// How the sources are used, which can be "first" (default) to try
+	// the sources in order until one succeeds, or "quorum" to ask all
+	// sources and use the address most of them agree on.
+	Policy string `json:"policy,omitempty"`
+
+	// The number of sources that should agree with policy quorum.
+	// Default: the majority of the sources
+	Quorum int `json:"quorum,omitempty"`
+
+	sources []IPSource
+}
+
+func (p *PublicIP) provision(ctx caddy.Context) error {
+
+	switch p.Policy {
+	case "", PolicyFirst:
+		p.Policy = PolicyFirst
+	case PolicyQuorum:
+	default:
+		return fmt.Errorf("unsupported public ip policy %s", p.Policy)
+	}
+
+	if len(p.SourcesRaw) == 0 {
+		p.sources = []IPSource{new(DNSSource)}
+	} else {
+
+		val, err := ctx.LoadModule(p, "SourcesRaw")
+
+		if err != nil {
+			return fmt.Errorf("loading ip source modules: %v", err)
+		}
+
+		for _, source := range val.([]any) {
+			p.sources = append(p.sources, source.(IPSource))
+		}
+	}
+
+	if p.Quorum <= 0 {
+		p.Quorum = len(p.sources)/2 + 1
+	}
+
+	if p.Quorum > len(p.sources) {
+		return fmt.Errorf("quorum of %d is more than the %d sources", p.Quorum, len(p.sources))
+	}
+
+	return nil
+}
+
+// Resolve returns the public address for the network "ip4", "ip6" or "ip",
+// where the latter returns the IPv4 address and falls back to IPv6. This
+// can be called on a nil config, which will use the default source.
+func (p *PublicIP) Resolve(ctx context.Context, network string) (netip.Addr, error) {
+
+	if nil == p {
+		p = &PublicIP{Policy: PolicyFirst, Quorum: 1, sources: []IPSource{new(DNSSource)}}
+	}
+
+	if network == "ip" {
+
+		ip, err := p.Resolve(ctx, "ip4")
+
+		if err == nil {
+			return ip, nil
+		}
+
+		ip, err6 := p.Resolve(ctx, "ip6")
+
+		if err6 != nil {
+			return netip.Addr{}, errors.Join(err, err6)
+		}
+
+		return ip, nil
+	}
+
+	if p.Policy == PolicyQuorum {
+		return p.quorum(ctx, network)
+	}
+
+	var errs = make([]error, 0)
+
+	for _, source := range p.sources {
+
+		ip, err := getSourceIP(ctx, source, network)
+
+		if err == nil {
+			return ip, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return netip.Addr{}, errors.Join(errs...)
+}
+
+// quorum asks all sources concurrently and returns the address
+// that is returned by at least the quorum of sources.
+func (p *PublicIP) quorum(ctx context.Context, network string) (netip.Addr, error) {
+
+	var ips = make([]netip.Addr, len(p.sources))
+	var errs = make([]error, len(p.sources))
+	var wg sync.WaitGroup
+
+	for idx, source := range p.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips[idx], errs[idx] = getSourceIP(ctx, source, network)
+		}()
+	}
+
+	wg.Wait()
+
+	var votes = make(map[netip.Addr]int)
+
+	for idx, ip := range ips {
+		if errs[idx] == nil {
+			if votes[ip]++; votes[ip] >= p.Quorum {
+				return ip, nil
+			}
+		}
+	}
+
+	return netip.Addr{}, errors.Join(append(errs, fmt.Errorf("no quorum of %d sources for %s address", p.Quorum, network))...)
+}
+
+// getSourceIP calls the source and checks if the returned
+// address is valid and belongs to the requested network.
+func getSourceIP(ctx context.Context, source IPSource, network string) (netip.Addr, error) {
+
+	ip, err := source.GetIP(ctx, network)
+
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%s: %w", source.(caddy.Module).CaddyModule().ID, err)
+	}
+
+	ip = ip.Unmap()
+
+	if false == ip.IsValid() || (network == "ip4") != ip.Is4() {
+		return netip.Addr{}, fmt.Errorf("%s: no valid %s address returned", source.(caddy.Module).CaddyModule().ID, network)
+	}
+
+	return ip, nil
+}
+
+// sourceContext returns the context with the timeout of a source.
+func sourceContext(ctx context.Context, timeout caddy.Duration) (context.Context, context.CancelFunc) {
+
+	if timeout <= 0 {
+		return context.WithTimeout(ctx, defaultIPSourceTimeout)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(timeout))
+}
+
+// UnmarshalCaddyfile sets up the public ip config from Caddyfile tokens. Syntax:
+//
+//	public_ip {
+//		policy first|quorum [<n>]
+//		source <name> ...
+//	}
+func (p *PublicIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "policy":
+			var args = d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			p.Policy = args[0]
+			if len(args) == 2 {
+				quorum, err := strconv.Atoi(args[1])
+				if err != nil {
+					return d.Errf("invalid quorum: %v", err)
+				}
+				p.Quorum = quorum
+			}
+		case "source":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+
+			var name = d.Val()
+
+			unm, err := caddyfile.UnmarshalModule(d, "ddns.ip_sources."+name)
+
+			if err != nil {
+				return err
+			}
+
+			p.SourcesRaw = append(p.SourcesRaw, caddyconfig.JSONModuleObject(unm, "source", name, nil))
+		default:
+			return d.Errf("unrecognized public_ip option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
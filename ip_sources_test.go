@@ -0,0 +1,252 @@
+package dyndns_handler
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/miekg/dns"
+)
+
+// staticSource is an IPSource that returns a fixed address or error.
+type staticSource struct {
+	ip  string
+	err error
+}
+
+func (staticSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{ID: "ddns.ip_sources.static"}
+}
+
+func (s staticSource) GetIP(context.Context, string) (netip.Addr, error) {
+
+	if nil != s.err {
+		return netip.Addr{}, s.err
+	}
+
+	return netip.ParseAddr(s.ip)
+}
+
+// listenUDP returns a local UDP socket that is closed when the test is done.
+func listenUDP(t *testing.T) net.PacketConn {
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestDNSSource(t *testing.T) {
+
+	var conn = listenUDP(t)
+	var started = make(chan struct{})
+	var server = &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+
+			var response = new(dns.Msg)
+			var question = request.Question[0]
+
+			response.SetReply(request)
+
+			switch question.Qtype {
+			case dns.TypeA:
+				response.Answer = append(response.Answer, &dns.A{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("198.51.100.1")})
+			case dns.TypeTXT:
+				response.Answer = append(response.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"198.51.100.2"}})
+			default:
+				response.Rcode = dns.RcodeNameError
+			}
+
+			_ = writer.WriteMsg(response)
+		}),
+	}
+
+	go server.ActivateAndServe()
+
+	<-started
+
+	t.Cleanup(func() { server.Shutdown() })
+
+	var tests = []struct {
+		kind string
+		ip   string
+	}{
+		{"", "198.51.100.1"},
+		{"TXT", "198.51.100.2"},
+	}
+
+	for _, test := range tests {
+
+		var source = &DNSSource{Server: conn.LocalAddr().String(), Name: "myip.example.com", Type: test.kind}
+
+		ip, err := source.GetIP(context.Background(), "ip4")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ip.String() != test.ip {
+			t.Fatalf("expected %s for type %q, got %s", test.ip, test.kind, ip)
+		}
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+
+	var server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/json":
+			fmt.Fprint(writer, `{"data": {"ip": "198.51.100.3"}}`)
+		case "/error":
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(writer, "198.51.100.4")
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	var tests = []struct {
+		source *HTTPSource
+		ip     string
+	}{
+		{&HTTPSource{URL: server.URL + "/plain"}, "198.51.100.4"},
+		{&HTTPSource{URL: server.URL + "/json", JSONPath: "data.ip"}, "198.51.100.3"},
+		{&HTTPSource{URL: server.URL + "/error"}, ""},
+	}
+
+	for _, test := range tests {
+
+		if err := test.source.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { test.source.Cleanup() })
+
+		ip, err := test.source.GetIP(context.Background(), "ip4")
+
+		if test.ip == "" {
+			if err == nil {
+				t.Fatalf("expected an error for %s, got %s", test.source.URL, ip)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ip.String() != test.ip {
+			t.Fatalf("expected %s for %s, got %s", test.ip, test.source.URL, ip)
+		}
+	}
+}
+
+func TestSTUNSource(t *testing.T) {
+
+	var conn = listenUDP(t)
+
+	// the stub ignores the first request, so the source has to retransmit
+	go func() {
+
+		var buf = make([]byte, 1500)
+
+		for i := 0; ; i++ {
+
+			size, remote, err := conn.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			if i == 0 || size < stunHeaderSize {
+				continue
+			}
+
+			var response = make([]byte, stunHeaderSize+stunAttributeHeaderSize+8)
+			var ip = netip.MustParseAddr("198.51.100.5").As4()
+
+			binary.BigEndian.PutUint16(response[0:], stunBindingResponse)
+			binary.BigEndian.PutUint16(response[2:], stunAttributeHeaderSize+8)
+			copy(response[4:20], buf[4:20])
+			binary.BigEndian.PutUint16(response[20:], stunXorMappedAddress)
+			binary.BigEndian.PutUint16(response[22:], 8)
+			response[25] = 0x01
+
+			for j := 0; j < 4; j++ {
+				response[28+j] = ip[j] ^ response[4+j]
+			}
+
+			_, _ = conn.WriteTo(response, remote)
+		}
+	}()
+
+	var source = &STUNSource{Server: conn.LocalAddr().String()}
+
+	ip, err := source.GetIP(context.Background(), "ip4")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "198.51.100.5" {
+		t.Fatalf("expected 198.51.100.5, got %s", ip)
+	}
+}
+
+func TestPublicIPResolve(t *testing.T) {
+
+	var failing = staticSource{err: errors.New("unavailable")}
+
+	var tests = []struct {
+		name   string
+		config *PublicIP
+		ip     string
+	}{
+		{"first skips failing sources", &PublicIP{Policy: PolicyFirst, sources: []IPSource{failing, staticSource{ip: "198.51.100.1"}}}, "198.51.100.1"},
+		{"first ignores wrong family", &PublicIP{Policy: PolicyFirst, sources: []IPSource{staticSource{ip: "2001:db8::1"}, staticSource{ip: "198.51.100.1"}}}, "198.51.100.1"},
+		{"quorum agrees", &PublicIP{Policy: PolicyQuorum, Quorum: 2, sources: []IPSource{staticSource{ip: "198.51.100.1"}, staticSource{ip: "198.51.100.2"}, staticSource{ip: "198.51.100.1"}}}, "198.51.100.1"},
+		{"quorum disagrees", &PublicIP{Policy: PolicyQuorum, Quorum: 2, sources: []IPSource{staticSource{ip: "198.51.100.1"}, staticSource{ip: "198.51.100.2"}, staticSource{ip: "198.51.100.3"}}}, ""},
+		{"quorum with failing source", &PublicIP{Policy: PolicyQuorum, Quorum: 2, sources: []IPSource{staticSource{ip: "198.51.100.1"}, failing, staticSource{ip: "198.51.100.2"}}}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			ip, err := test.config.Resolve(context.Background(), "ip4")
+
+			if test.ip == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", ip)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ip.String() != test.ip {
+				t.Fatalf("expected %s, got %s", test.ip, ip)
+			}
+		})
+	}
+}
+
+var (
+	_ IPSource = staticSource{}
+)
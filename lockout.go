@@ -0,0 +1,371 @@
+package dyndns_handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// maxLockoutEntries limits the number of counters kept in memory, where
+// the counter that was least recently updated is dropped first.
+const maxLockoutEntries = 10000
+
+// Lockout keeps track of failed authentication attempts per client ip
+// (and optionally username). After reaching the threshold, the client
+// is locked out for a duration that doubles with every following failure
+// and will get "abuse" as response until the lockout expires.
+type Lockout struct {
+
+	// Number of failed attempts before a client gets locked out. Default: 5
+	Threshold int `json:"threshold,omitempty"`
+
+	// The duration of the first lockout. Default: 1m
+	Duration caddy.Duration `json:"duration,omitempty"`
+
+	// The maximum duration of a lockout. Default: 1h
+	MaxDuration caddy.Duration `json:"max_duration,omitempty"`
+
+	// Time without failures after which the counters are reset. Default: 24h
+	Reset caddy.Duration `json:"reset,omitempty"`
+
+	// When true, failures are also counted per username, so a username
+	// is locked out independent of the client ip. Note that this allows
+	// anyone to lock out a user by guessing its password.
+	PerUser bool `json:"per_user,omitempty"`
+
+	// When true, the counters are persisted in the configured storage
+	// so they will survive restarts.
+	Persist bool `json:"persist,omitempty"`
+
+	// The storage key used when persisting. Default: derived from
+	// the handler config, see lockoutStorageKey
+	StorageKey string `json:"storage_key,omitempty"`
+
+	entries map[string]*lockoutEntry
+	mu      sync.Mutex
+	dirty   bool
+	storage certmagic.Storage
+	logger  *zap.Logger
+}
+
+type lockoutEntry struct {
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`
+	Until    time.Time `json:"until,omitempty"`
+}
+
+func (l *Lockout) provision(ctx caddy.Context, logger *zap.Logger) error {
+
+	if l.Threshold <= 0 {
+		l.Threshold = 5
+	}
+
+	if l.Duration <= 0 {
+		l.Duration = caddy.Duration(time.Minute)
+	}
+
+	if l.MaxDuration <= 0 {
+		l.MaxDuration = caddy.Duration(time.Hour)
+	}
+
+	if l.Reset <= 0 {
+		l.Reset = caddy.Duration(24 * time.Hour)
+	}
+
+	l.entries = make(map[string]*lockoutEntry)
+	l.logger = logger
+
+	if false == l.Persist {
+		return nil
+	}
+
+	l.storage = ctx.Storage()
+
+	data, err := l.storage.Load(ctx, l.StorageKey)
+
+	if err != nil && false == errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("loading lockout counters: %v", err)
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &l.entries); err != nil {
+			logger.Warn("ignoring invalid lockout counters", zap.Error(err))
+			l.entries = make(map[string]*lockoutEntry)
+		}
+	}
+
+	l.expire(time.Now())
+
+	go l.persist(ctx)
+
+	return nil
+}
+
+// lockoutStorageKey returns the default storage key for the counters of
+// the handler, which is derived from the handler config so handlers do
+// not share their counters.
+func lockoutStorageKey(config *Handler) (string, error) {
+
+	data, err := json.Marshal(config)
+
+	if err != nil {
+		return "", err
+	}
+
+	var sum = sha256.Sum256(data)
+
+	return fmt.Sprintf("ddns/lockout-%x.json", sum[:8]), nil
+}
+
+// persist writes the counters periodically to the storage
+// when changed, and one last time when the config unloads.
+func (l *Lockout) persist(ctx caddy.Context) {
+
+	var ticker = time.NewTicker(30 * time.Second)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			l.save(context.Background())
+			return
+		case <-ticker.C:
+			l.save(ctx)
+		}
+	}
+}
+
+func (l *Lockout) save(ctx context.Context) {
+
+	l.mu.Lock()
+
+	if false == l.dirty {
+		l.mu.Unlock()
+		return
+	}
+
+	l.expire(time.Now())
+
+	data, err := json.Marshal(l.entries)
+
+	l.dirty = false
+	l.mu.Unlock()
+
+	if err == nil {
+		err = l.storage.Store(ctx, l.StorageKey, data)
+	}
+
+	if err != nil {
+		l.logger.Error("could not persist lockout counters", zap.Error(err))
+	}
+}
+
+// expire removes the entries that were reset, the
+// caller is expected to hold the lock when running.
+func (l *Lockout) expire(now time.Time) {
+	for key, entry := range l.entries {
+		if now.Sub(entry.Last) > time.Duration(l.Reset) && now.After(entry.Until) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// Locked returns true when the client ip or (with PerUser)
+// the username of the request is locked out.
+func (l *Lockout) Locked(request *http.Request) bool {
+
+	if nil == l {
+		return false
+	}
+
+	var now = time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range l.keys(request) {
+		if entry, ok := l.entries[key]; ok && now.Before(entry.Until) {
+			l.logger.Warn("client locked out", zap.String("key", key), zap.Time("until", entry.Until))
+			return true
+		}
+	}
+
+	return false
+}
+
+// Failed registers a failed authentication attempt for the
+// client ip and (with PerUser) the username of the request.
+func (l *Lockout) Failed(request *http.Request) {
+
+	if nil == l {
+		return
+	}
+
+	var now = time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire(now)
+
+	for _, key := range l.keys(request) {
+
+		entry, ok := l.entries[key]
+
+		if !ok {
+			l.evict()
+			entry = new(lockoutEntry)
+			l.entries[key] = entry
+		}
+
+		entry.Failures++
+		entry.Last = now
+
+		if entry.Failures >= l.Threshold {
+
+			var duration = time.Duration(l.Duration)
+
+			for i := l.Threshold; i < entry.Failures && duration < time.Duration(l.MaxDuration); i++ {
+				duration *= 2
+			}
+
+			entry.Until = now.Add(min(duration, time.Duration(l.MaxDuration)))
+
+			l.logger.Warn("client locked out after failed attempts", zap.String("key", key), zap.Int("failures", entry.Failures), zap.Time("until", entry.Until))
+		}
+	}
+
+	l.dirty = true
+}
+
+// Succeeded resets the counter for the username (with PerUser) of the request. The
+// counter of the client ip is kept, so a client with one valid account
+// cannot keep guessing the passwords of other users.
+func (l *Lockout) Succeeded(request *http.Request) {
+
+	if nil == l {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range l.keys(request) {
+
+		if strings.HasPrefix(key, "ip:") {
+			continue
+		}
+
+		if _, ok := l.entries[key]; ok {
+			delete(l.entries, key)
+			l.dirty = true
+		}
+	}
+}
+
+// evict drops the least recently updated counter when the maximum number
+// of counters is reached, the caller is expected to hold the lock.
+func (l *Lockout) evict() {
+
+	if len(l.entries) < maxLockoutEntries {
+		return
+	}
+
+	var oldest string
+
+	for key, entry := range l.entries {
+		if oldest == "" || entry.Last.Before(l.entries[oldest].Last) {
+			oldest = key
+		}
+	}
+
+	delete(l.entries, oldest)
+}
+
+func (l *Lockout) keys(request *http.Request) []string {
+
+	var keys = make([]string, 0, 2)
+
+	if ip := clientIP(request); ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+
+	if name, _, ok := request.BasicAuth(); ok && name != "" && l.PerUser {
+		keys = append(keys, "user:"+name)
+	}
+
+	return keys
+}
+
+// UnmarshalCaddyfile sets up the lockout from Caddyfile tokens. Syntax:
+//
+//	lockout {
+//		threshold		<count>
+//		duration		<duration>
+//		max_duration	<duration>
+//		reset			<duration>
+//		per_user
+//		persist			[<storage key>]
+//	}
+func (l *Lockout) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "threshold":
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid threshold: %v", err)
+			}
+			l.Threshold = threshold
+		case "duration", "max_duration", "reset":
+			var name, value = d.Val(), ""
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid %s: %v", name, err)
+			}
+			switch name {
+			case "duration":
+				l.Duration = caddy.Duration(duration)
+			case "max_duration":
+				l.MaxDuration = caddy.Duration(duration)
+			case "reset":
+				l.Reset = caddy.Duration(duration)
+			}
+		case "per_user":
+			l.PerUser = true
+		case "persist":
+			l.Persist = true
+			if d.NextArg() {
+				l.StorageKey = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized lockout option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package dyndns_handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// newTestLockout returns a lockout after 3 failures, starting at
+// 1m and capped at 4m, with the counters reset after an hour.
+func newTestLockout(t *testing.T, perUser bool) *Lockout {
+
+	var lockout = &Lockout{
+		Threshold:   3,
+		Duration:    caddy.Duration(time.Minute),
+		MaxDuration: caddy.Duration(4 * time.Minute),
+		Reset:       caddy.Duration(time.Hour),
+		PerUser:     perUser,
+	}
+
+	if err := lockout.provision(caddy.Context{}, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+
+	return lockout
+}
+
+// lockoutRequest returns a request from the given ip, with
+// basic authentication when the username is not empty.
+func lockoutRequest(ip, name string) *http.Request {
+
+	var request = httptest.NewRequest("GET", "/nic/update", nil)
+
+	request.RemoteAddr = ip + ":5000"
+
+	if name != "" {
+		request.SetBasicAuth(name, "wrong")
+	}
+
+	return request
+}
+
+func TestLockoutThreshold(t *testing.T) {
+
+	var lockout = newTestLockout(t, false)
+	var request = lockoutRequest("192.0.2.10", "foo")
+
+	for i := 1; i <= 3; i++ {
+
+		if lockout.Locked(request) {
+			t.Fatalf("expected no lockout after %d failures", i-1)
+		}
+
+		lockout.Failed(request)
+	}
+
+	if false == lockout.Locked(request) {
+		t.Fatal("expected a lockout after 3 failures")
+	}
+
+	// without per_user, the username is not locked out on other addresses
+	if lockout.Locked(lockoutRequest("192.0.2.11", "foo")) {
+		t.Fatal("expected no lockout for another address")
+	}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+
+	var lockout = newTestLockout(t, false)
+	var request = lockoutRequest("192.0.2.10", "")
+	var expected = []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute}
+
+	for i, duration := range expected {
+
+		lockout.Failed(request)
+
+		var entry = lockout.entries["ip:192.0.2.10"]
+
+		if until := entry.Until.Sub(entry.Last); duration > 0 && until != duration {
+			t.Fatalf("expected a lockout of %s after %d failures, got %s", duration, i+1, until)
+		}
+
+		if duration == 0 && false == entry.Until.IsZero() {
+			t.Fatalf("expected no lockout after %d failures", i+1)
+		}
+	}
+}
+
+func TestLockoutReset(t *testing.T) {
+
+	var lockout = newTestLockout(t, false)
+	var request = lockoutRequest("192.0.2.10", "")
+
+	for i := 0; i < 3; i++ {
+		lockout.Failed(request)
+	}
+
+	var entry = lockout.entries["ip:192.0.2.10"]
+
+	// still locked out, so the counter is kept
+	entry.Last = entry.Last.Add(-2 * time.Hour)
+	lockout.expire(time.Now())
+
+	if _, ok := lockout.entries["ip:192.0.2.10"]; false == ok {
+		t.Fatal("expected the counter to be kept while locked out")
+	}
+
+	entry.Until = entry.Last
+
+	lockout.Failed(request)
+
+	if entry := lockout.entries["ip:192.0.2.10"]; entry.Failures != 1 {
+		t.Fatalf("expected the counter to be reset, got %d failures", entry.Failures)
+	}
+}
+
+func TestLockoutSucceeded(t *testing.T) {
+
+	var lockout = newTestLockout(t, true)
+	var request = lockoutRequest("192.0.2.10", "foo")
+
+	lockout.Failed(request)
+	lockout.Failed(lockoutRequest("192.0.2.11", "foo"))
+	lockout.Succeeded(request)
+
+	if entry, ok := lockout.entries["ip:192.0.2.10"]; false == ok || entry.Failures != 1 {
+		t.Fatal("expected the counter of the ip to be kept")
+	}
+
+	if _, ok := lockout.entries["user:foo"]; ok {
+		t.Fatal("expected the counter of the user to be reset")
+	}
+}
+
+func TestLockoutPerUser(t *testing.T) {
+
+	var lockout = newTestLockout(t, true)
+
+	for i := 0; i < 3; i++ {
+		lockout.Failed(lockoutRequest(fmt.Sprintf("192.0.2.%d", 10+i), "foo"))
+	}
+
+	if false == lockout.Locked(lockoutRequest("192.0.2.20", "foo")) {
+		t.Fatal("expected the user to be locked out on other addresses")
+	}
+
+	if lockout.Locked(lockoutRequest("192.0.2.20", "bar")) {
+		t.Fatal("expected other users not to be locked out")
+	}
+}
+
+func TestLockoutMaxEntries(t *testing.T) {
+
+	var lockout = newTestLockout(t, false)
+	var now = time.Now()
+
+	for i := 0; i < maxLockoutEntries; i++ {
+		lockout.entries[fmt.Sprintf("ip:%d", i)] = &lockoutEntry{Failures: 1, Last: now.Add(time.Duration(i) * time.Second)}
+	}
+
+	lockout.Failed(lockoutRequest("192.0.2.10", ""))
+
+	if len(lockout.entries) != maxLockoutEntries {
+		t.Fatalf("expected %d counters, got %d", maxLockoutEntries, len(lockout.entries))
+	}
+
+	if _, ok := lockout.entries["ip:0"]; ok {
+		t.Fatal("expected the least recently updated counter to be dropped")
+	}
+}
+
+func TestLockoutStorageKey(t *testing.T) {
+
+	var keys = make([]string, 0, 3)
+
+	for _, domain := range []string{"example.com", "example.com", "example.org"} {
+
+		key, err := lockoutStorageKey(&Handler{Domain: domain, Lockout: &Lockout{Persist: true}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if keys[0] != keys[1] || keys[0] == keys[2] {
+		t.Fatalf("expected the same key for the same config only, got %v", keys)
+	}
+}
@@ -0,0 +1,223 @@
+package dyndns_handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/libdns/libdns"
+)
+
+// OptionsProvider wraps a provider to set provider specific options,
+// like the minimum and maximum TTL the provider accepts and the view
+// (public or internal) the provider serves.
+type OptionsProvider struct {
+	ProviderRaw json.RawMessage `json:"provider,omitempty" caddy:"namespace=dns.providers inline_key=name"`
+
+	// The minimum TTL of the records, lower TTLs are raised to this value.
+	MinTTL caddy.Duration `json:"min_ttl,omitempty"`
+
+	// The maximum TTL of the records, higher TTLs are lowered to this value.
+	MaxTTL caddy.Duration `json:"max_ttl,omitempty"`
+
+	// The view of the provider, where "public" (default) providers get
+	// the WAN address and "internal" providers the LAN address.
+	View string `json:"view,omitempty"`
+
+	provider Provider
+}
+
+// ttlLimiter is implemented by providers that only accept TTLs within
+// a range, so the handler can compare the records with the TTL that
+// will be used by the provider.
+type ttlLimiter interface {
+	limitTTL(ttl time.Duration) time.Duration
+}
+
+func (o *OptionsProvider) limitTTL(ttl time.Duration) time.Duration {
+
+	if ttl == 0 {
+		return ttl
+	}
+
+	if o.MinTTL > 0 && ttl < time.Duration(o.MinTTL) {
+		ttl = time.Duration(o.MinTTL)
+	}
+
+	if o.MaxTTL > 0 && ttl > time.Duration(o.MaxTTL) {
+		ttl = time.Duration(o.MaxTTL)
+	}
+
+	return ttl
+}
+
+// limitRecords returns the records with the TTL within limits, where the
+// records that need a different TTL are converted with libdns.RR.Parse.
+func (o *OptionsProvider) limitRecords(records []libdns.Record) []libdns.Record {
+
+	var result = make([]libdns.Record, len(records))
+
+	for idx, record := range records {
+
+		var rr = record.RR()
+		var ttl = o.limitTTL(rr.TTL)
+
+		if ttl == rr.TTL {
+			result[idx] = record
+			continue
+		}
+
+		rr.TTL = ttl
+
+		if parsed, err := rr.Parse(); err == nil {
+			result[idx] = parsed
+		} else {
+			result[idx] = rr
+		}
+	}
+
+	return result
+}
+
+func (o *OptionsProvider) view() string {
+
+	if o.View == "" {
+		return ViewPublic
+	}
+
+	return o.View
+}
+
+func (o *OptionsProvider) SetRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return o.provider.SetRecords(ctx, zone, o.limitRecords(recs))
+}
+
+func (o *OptionsProvider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return o.provider.AppendRecords(ctx, zone, o.limitRecords(recs))
+}
+
+func (o *OptionsProvider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	return o.provider.GetRecords(ctx, zone)
+}
+
+func (o *OptionsProvider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return o.provider.DeleteRecords(ctx, zone, recs)
+}
+
+func (o *OptionsProvider) ListZones(ctx context.Context) ([]libdns.Zone, error) {
+	return o.provider.ListZones(ctx)
+}
+
+func init() {
+	caddy.RegisterModule(OptionsProvider{})
+}
+
+func (OptionsProvider) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "dns.providers.ddns.options",
+		New: func() caddy.Module {
+			return new(OptionsProvider)
+		},
+	}
+}
+
+func (o *OptionsProvider) Provision(ctx caddy.Context) error {
+
+	if len(o.ProviderRaw) == 0 {
+		return fmt.Errorf("no DNS provider defined")
+	}
+
+	if o.MinTTL > 0 && o.MaxTTL > 0 && o.MinTTL > o.MaxTTL {
+		return fmt.Errorf("min_ttl is greater than max_ttl")
+	}
+
+	switch o.View {
+	case "", ViewPublic, ViewInternal:
+	default:
+		return fmt.Errorf("unsupported view %s", o.View)
+	}
+
+	val, err := ctx.LoadModule(o, "ProviderRaw")
+
+	if err != nil {
+		return fmt.Errorf("failed loading DNS provider module: %v", err)
+	}
+
+	if _, ok := val.(Provider); !ok {
+		return fmt.Errorf("expected provider module to implement libdns.{RecordSetter, RecordDeleter, RecordAppender, RecordGetter, ZoneLister}")
+	}
+
+	o.provider = val.(Provider)
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the options DNS provider from Caddyfile tokens. Syntax:
+//
+//	ddns.options {
+//		provider <name> ...
+//		min_ttl <duration>
+//		max_ttl <duration>
+//		view public|internal
+//	}
+func (o *OptionsProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	if !d.Next() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "provider":
+
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+
+			var name = d.Val()
+
+			encoder, err := caddyfile.UnmarshalModule(d, "dns.providers."+name)
+
+			if err != nil {
+				return err
+			}
+
+			o.ProviderRaw = caddyconfig.JSONModuleObject(encoder, "name", name, nil)
+		case "min_ttl", "max_ttl":
+			var name, value = d.Val(), ""
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid %s: %v", name, err)
+			}
+			if name == "min_ttl" {
+				o.MinTTL = caddy.Duration(ttl)
+			} else {
+				o.MaxTTL = caddy.Duration(ttl)
+			}
+		case "view":
+			if !d.AllArgs(&o.View) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized ddns.options option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*OptionsProvider)(nil)
+	_ caddy.Provisioner     = (*OptionsProvider)(nil)
+	_ Provider              = (*OptionsProvider)(nil)
+	_ ttlLimiter            = (*OptionsProvider)(nil)
+	_ viewer                = (*OptionsProvider)(nil)
+)
@@ -1,6 +1,15 @@
 package dyndns_handler
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/libdns/libdns"
 )
 
@@ -15,3 +24,93 @@ type BaseProvider interface {
 	libdns.RecordAppender
 	libdns.RecordGetter
 }
+
+// loadProviders loads the DNS provider modules of the given field and
+// validates that they implement all interfaces needed for updating.
+func loadProviders(ctx caddy.Context, module any, field string) ([]Provider, error) {
+
+	var providers = make([]Provider, 0)
+
+	val, err := ctx.LoadModule(module, field)
+
+	if err != nil {
+		return nil, fmt.Errorf("loading DNS providers module: %v", err)
+	}
+
+	var interfaces = []reflect.Type{
+		reflect.TypeOf((*libdns.RecordAppender)(nil)).Elem(),
+		reflect.TypeOf((*libdns.RecordGetter)(nil)).Elem(),
+		reflect.TypeOf((*libdns.RecordSetter)(nil)).Elem(),
+		reflect.TypeOf((*libdns.RecordDeleter)(nil)).Elem(),
+		reflect.TypeOf((*libdns.ZoneLister)(nil)).Elem(),
+	}
+
+	for i, c := 0, len(val.([]interface{})); i < c; i++ {
+
+		var value = reflect.ValueOf(val.([]interface{})[i])
+		var missing = make([]string, 0)
+		var zoneHint = false
+
+		if value.CanAddr() {
+			value = value.Elem()
+		}
+
+		for _, expecting := range interfaces {
+
+			if false == value.Type().Implements(expecting) {
+				missing = append(missing, expecting.Name())
+
+				if "ZoneLister" == expecting.Name() {
+					zoneHint = true
+				}
+			}
+		}
+
+		if len(missing) > 0 {
+
+			var err = fmt.Sprintf("DNS provider %s should implement ", ProviderName(value.Interface().(caddy.Module)))
+
+			if len(missing) == 1 {
+				err += "libdns." + missing[0]
+			} else {
+				err += "libdns.{" + strings.Join(missing, ", ") + "}"
+			}
+
+			if zoneHint {
+				err += " (use provider ddns.static_zones to manually define zones)"
+			}
+
+			return nil, errors.New(err)
+
+		}
+
+		providers = append(providers, value.Interface().(Provider))
+	}
+
+	return providers, nil
+}
+
+// unmarshalProviders parses a block of DNS provider modules from Caddyfile tokens. Syntax:
+//
+//	providers {
+//		<name> ...
+//	}
+func unmarshalProviders(d *caddyfile.Dispenser) ([]json.RawMessage, error) {
+
+	var providers = make([]json.RawMessage, 0)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+
+		var name = d.Val()
+
+		encoder, err := caddyfile.UnmarshalModule(d, "dns.providers."+name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		providers = append(providers, caddyconfig.JSONModuleObject(encoder, "name", name, nil))
+	}
+
+	return providers, nil
+}
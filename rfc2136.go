@@ -0,0 +1,700 @@
+package dyndns_handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// RFC2136Server accepts TSIG signed dynamic update messages as described
+// in RFC 2136 and applies them with the configured DNS providers, so
+// clients like nsupdate or DHCP servers can update any libdns provider.
+type RFC2136Server struct {
+
+	// The addresses to listen on (both UDP and TCP). Default: :53
+	Listen []string `json:"listen,omitempty"`
+
+	// The TSIG keys for signing the update messages, unsigned
+	// messages are refused.
+	Keys []*TSIGKey `json:"keys,omitempty"`
+
+	// The provider configurations with which the updates
+	// will be applied.
+	ProvidersRaw []json.RawMessage `json:"providers,omitempty" caddy:"namespace=dns.providers inline_key=name"`
+
+	// How long the zones of the providers are cached. Default: 10m
+	ZonesTTL caddy.Duration `json:"zones_ttl,omitempty"`
+
+	providers []Provider
+	zones     *zoneCache
+	servers   []*dns.Server
+	keys      map[string]*TSIGKey
+	ctx       caddy.Context
+	logger    *zap.Logger
+}
+
+// TSIGKey is a shared secret for signing update messages.
+type TSIGKey struct {
+
+	// The name of the key
+	Name string `json:"name"`
+
+	// The base64 encoded secret
+	Secret string `json:"secret"`
+
+	// The HMAC algorithm used for signing. Default: hmac-sha256
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// The zones that can be updated with this key,
+	// when empty all zones are allowed.
+	Zones []string `json:"zones,omitempty"`
+}
+
+func (s *RFC2136Server) provision(ctx caddy.Context, logger *zap.Logger) error {
+
+	if len(s.ProvidersRaw) == 0 {
+		return fmt.Errorf("no DNS providers defined")
+	}
+
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("no TSIG keys defined")
+	}
+
+	if len(s.Listen) == 0 {
+		s.Listen = []string{":53"}
+	}
+
+	providers, err := loadProviders(ctx, s, "ProvidersRaw")
+
+	if err != nil {
+		return err
+	}
+
+	s.providers = providers
+	s.zones = newZoneCache(ctx, providers, time.Duration(s.ZonesTTL), logger)
+	s.keys = make(map[string]*TSIGKey)
+	s.ctx = ctx
+	s.logger = logger
+
+	for _, key := range s.Keys {
+
+		if key.Algorithm == "" {
+			key.Algorithm = dns.HmacSHA256
+		}
+
+		key.Name = dns.CanonicalName(key.Name)
+		key.Algorithm = dns.CanonicalName(key.Algorithm)
+
+		switch key.Algorithm {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return fmt.Errorf("key %s: unsupported algorithm %s", key.Name, key.Algorithm)
+		}
+
+		if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil {
+			return fmt.Errorf("key %s: invalid secret: %v", key.Name, err)
+		}
+
+		if _, x := s.keys[key.Name]; x {
+			return fmt.Errorf("duplicate key %s", key.Name)
+		}
+
+		s.keys[key.Name] = key
+	}
+
+	return nil
+}
+
+func (s *RFC2136Server) start() (err error) {
+
+	// stop the servers that were already started when one fails
+	defer func() {
+		if err != nil {
+			s.stop()
+		}
+	}()
+
+	var secrets = make(map[string]string)
+
+	for name, key := range s.keys {
+		secrets[name] = key.Secret
+	}
+
+	for _, listen := range s.Listen {
+
+		addr, err := caddy.ParseNetworkAddressWithDefaults(listen, "udp", 53)
+
+		if err != nil {
+			return err
+		}
+
+		for _, network := range []string{"udp", "tcp"} {
+
+			addr.Network = network
+
+			ln, err := addr.Listen(s.ctx, 0, net.ListenConfig{})
+
+			if err != nil {
+				return fmt.Errorf("listening on %s: %v", addr, err)
+			}
+
+			// wait until the server is serving (or could not be activated), so stop
+			// is never called on a server that is still starting, which fails
+			// with "server not started" and leaves the server running.
+			var started = make(chan struct{})
+			var failed = make(chan error, 1)
+			var address = addr.String()
+			var server = &dns.Server{
+				Handler:           s,
+				TsigSecret:        secrets,
+				MsgAcceptFunc:     acceptUpdateMessage,
+				NotifyStartedFunc: func() { close(started) },
+			}
+
+			switch x := ln.(type) {
+			case net.PacketConn:
+				server.PacketConn = x
+			case net.Listener:
+				server.Listener = x
+			}
+
+			go func() {
+				if err := server.ActivateAndServe(); err != nil {
+					select {
+					case <-started:
+						s.logger.Error("server stopped", zap.String("address", address), zap.Error(err))
+					default:
+						failed <- err
+					}
+				}
+			}()
+
+			select {
+			case <-started:
+			case err := <-failed:
+				_ = ln.(io.Closer).Close()
+				return fmt.Errorf("serving on %s: %v", address, err)
+			}
+
+			s.servers = append(s.servers, server)
+
+			s.logger.Info("listening for dynamic updates", zap.String("address", address))
+		}
+	}
+
+	return nil
+}
+
+func (s *RFC2136Server) stop() {
+	for _, server := range s.servers {
+		if err := server.Shutdown(); err != nil {
+			s.logger.Debug("shutting down server", zap.Error(err))
+		}
+	}
+	s.servers = nil
+}
+
+// acceptUpdateMessage only accepts update messages with exactly one zone.
+func acceptUpdateMessage(header dns.Header) dns.MsgAcceptAction {
+
+	if header.Bits&(1<<15) != 0 { // response bit
+		return dns.MsgIgnore
+	}
+
+	if opcode := int(header.Bits>>11) & 0xF; opcode != dns.OpcodeUpdate {
+		return dns.MsgRejectNotImplemented
+	}
+
+	if header.Qdcount != 1 {
+		return dns.MsgReject
+	}
+
+	return dns.MsgAccept
+}
+
+// ServeDNS handles the update messages, see https://datatracker.ietf.org/doc/html/rfc2136#section-3
+func (s *RFC2136Server) ServeDNS(writer dns.ResponseWriter, request *dns.Msg) {
+
+	var response = new(dns.Msg)
+
+	response.SetRcode(request, s.update(writer, request))
+
+	if tsig := request.IsTsig(); tsig != nil && writer.TsigStatus() == nil {
+		response.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	if err := writer.WriteMsg(response); err != nil {
+		s.logger.Error("could not write response", zap.Error(err))
+	}
+}
+
+func (s *RFC2136Server) update(writer dns.ResponseWriter, request *dns.Msg) int {
+
+	var zone = request.Question[0]
+	var logger = s.logger.With(zap.String("zone", zone.Name), zap.String("remote", writer.RemoteAddr().String()))
+	var tsig = request.IsTsig()
+
+	if tsig == nil {
+		logger.Warn("refused unsigned update")
+		return dns.RcodeRefused
+	}
+
+	logger = logger.With(zap.String("key", tsig.Hdr.Name))
+
+	if err := writer.TsigStatus(); err != nil {
+		logger.Warn("invalid signature", zap.Error(err))
+		return dns.RcodeNotAuth
+	}
+
+	if key := s.keys[dns.CanonicalName(tsig.Hdr.Name)]; key == nil || key.Algorithm != dns.CanonicalName(tsig.Algorithm) {
+		logger.Warn("invalid key or algorithm")
+		return dns.RcodeNotAuth
+	} else if false == key.allows(zone.Name) {
+		logger.Warn("key not allowed for zone")
+		return dns.RcodeRefused
+	}
+
+	if zone.Qtype != dns.TypeSOA || zone.Qclass != dns.ClassINET {
+		return dns.RcodeFormatError
+	}
+
+	var ctx, cancel = context.WithTimeout(s.ctx, 30*time.Second)
+
+	defer cancel()
+
+	provider, name := s.findZone(ctx, zone.Name)
+
+	if provider == nil {
+		logger.Warn("zone not supported by providers")
+		return dns.RcodeNotAuth
+	}
+
+	for _, rr := range append(request.Answer, request.Ns...) {
+		if false == dns.IsSubDomain(zone.Name, rr.Header().Name) {
+			return dns.RcodeNotZone
+		}
+	}
+
+	var existing []libdns.Record
+
+	if len(request.Answer) > 0 {
+
+		records, err := provider.GetRecords(ctx, name)
+
+		if err != nil {
+			logger.Error("could not fetch records", zap.Error(err))
+			return dns.RcodeServerFailure
+		}
+
+		existing = records
+
+		if rcode := checkPrerequisites(request.Answer, existing, zone.Name); rcode != dns.RcodeSuccess {
+			logger.Info("prerequisites not satisfied", zap.String("rcode", dns.RcodeToString[rcode]))
+			return rcode
+		}
+	}
+
+	if rcode := checkUpdates(request.Ns); rcode != dns.RcodeSuccess {
+		logger.Info("invalid update section", zap.String("rcode", dns.RcodeToString[rcode]))
+		return rcode
+	}
+
+	if err := s.applyUpdates(ctx, provider, name, zone.Name, request.Ns); err != nil {
+		logger.Error("applying updates failed", zap.Error(err))
+		return dns.RcodeServerFailure
+	}
+
+	logger.Info("dynamic update applied", zap.Int("updates", len(request.Ns)))
+
+	return dns.RcodeSuccess
+}
+
+// findZone returns the provider which supports the given zone, together
+// with the zone name as returned by the provider.
+func (s *RFC2136Server) findZone(ctx context.Context, zone string) (Provider, string) {
+
+	for idx, items := range s.zones.Get(ctx) {
+		for _, item := range items {
+			if dns.CanonicalName(item) == dns.CanonicalName(zone) {
+				return s.providers[idx], item
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// applyUpdates processes the update section in order, where consecutive
+// additions or deletions are combined into a single provider call.
+func (s *RFC2136Server) applyUpdates(ctx context.Context, provider Provider, name, zone string, updates []dns.RR) error {
+
+	var batch = make([]libdns.Record, 0)
+	var adding = false
+
+	var flush = func() error {
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		var err error
+
+		if adding {
+			// adding an existing record is ignored, see section 3.4.2.2
+			_, err = appendMissingRecords(provider, ctx, name, batch)
+		} else {
+			_, err = provider.DeleteRecords(ctx, name, batch)
+		}
+
+		batch = make([]libdns.Record, 0)
+
+		return err
+	}
+
+	for _, rr := range updates {
+
+		var header = rr.Header()
+		var relative = libdns.RelativeName(dns.CanonicalName(header.Name), dns.CanonicalName(zone))
+		var records []libdns.Record
+		var add = false
+
+		switch {
+		case header.Class == dns.ClassINET:
+			// add to an RRset
+			add, records = true, []libdns.Record{toLibdnsRecord(rr, relative)}
+		case header.Class == dns.ClassANY && header.Rrtype == dns.TypeANY && relative == "@":
+			// delete all RRsets of the apex except the SOA and NS, which
+			// are looked up after applying the changes before this one
+			if err := flush(); err != nil {
+				return err
+			}
+			apex, err := apexRRsets(ctx, provider, name)
+			if err != nil {
+				return err
+			}
+			records = apex
+		case header.Class == dns.ClassANY && header.Rrtype == dns.TypeANY:
+			// delete all RRsets from a name
+			records = []libdns.Record{libdns.RR{Name: relative}}
+		case header.Class == dns.ClassANY:
+			// delete an RRset
+			if relative == "@" && (header.Rrtype == dns.TypeSOA || header.Rrtype == dns.TypeNS) {
+				continue
+			}
+			records = []libdns.Record{libdns.RR{Name: relative, Type: dns.TypeToString[header.Rrtype]}}
+		case header.Class == dns.ClassNONE:
+			// delete an RR from an RRset
+			if header.Rrtype == dns.TypeSOA {
+				continue
+			}
+			var record = toLibdnsRecord(rr, relative).RR()
+			record.TTL = 0
+			records = []libdns.Record{record}
+		}
+
+		if add != adding {
+			if err := flush(); err != nil {
+				return err
+			}
+			adding = add
+		}
+
+		batch = append(batch, records...)
+	}
+
+	return flush()
+}
+
+// apexRRsets returns a record without data for every RRset of the apex of
+// the zone, except the SOA and NS, which matches all records of the RRset
+// when deleting.
+func apexRRsets(ctx context.Context, provider Provider, zone string) ([]libdns.Record, error) {
+
+	current, err := provider.GetRecords(ctx, zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var types = make([]string, 0)
+
+	for _, record := range current {
+
+		var rr = record.RR()
+
+		if normalizeName(libdns.AbsoluteName(rr.Name, zone)) != normalizeName(zone) || rr.Type == "SOA" || rr.Type == "NS" || slices.Contains(types, rr.Type) {
+			continue
+		}
+
+		types = append(types, rr.Type)
+	}
+
+	return typeRecords(types...)(zone, zone, 0), nil
+}
+
+// checkUpdates validates the classes, types, TTLs and data of the update section,
+// see https://datatracker.ietf.org/doc/html/rfc2136#section-3.4.1.3
+func checkUpdates(updates []dns.RR) int {
+
+	for _, rr := range updates {
+
+		var header = rr.Header()
+
+		switch header.Rrtype {
+		case dns.TypeAXFR, dns.TypeMAILA, dns.TypeMAILB:
+			return dns.RcodeFormatError
+		}
+
+		switch header.Class {
+		case dns.ClassINET:
+			if header.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 || header.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites validates the prerequisite section against the existing records,
+// see https://datatracker.ietf.org/doc/html/rfc2136#section-3.2
+func checkPrerequisites(prerequisites []dns.RR, existing []libdns.Record, zone string) int {
+
+	var records = make([]dns.RR, 0, len(existing))
+
+	for _, record := range existing {
+		if rr, err := toDNSRecord(record, zone); err == nil {
+			records = append(records, rr)
+		}
+	}
+
+	var find = func(name string, rrtype uint16) []dns.RR {
+		var found = make([]dns.RR, 0)
+		for _, rr := range records {
+			if strings.EqualFold(rr.Header().Name, name) && (rrtype == dns.TypeANY || rr.Header().Rrtype == rrtype) {
+				found = append(found, rr)
+			}
+		}
+		return found
+	}
+
+	// value dependent prerequisites, grouped by name and type
+	var expected = make(map[string][]dns.RR)
+
+	for _, rr := range prerequisites {
+
+		var header = rr.Header()
+		var name = dns.CanonicalName(header.Name)
+
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if len(find(name, header.Rrtype)) == 0 {
+				if header.Rrtype == dns.TypeANY {
+					return dns.RcodeNameError
+				}
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if len(find(name, header.Rrtype)) > 0 {
+				if header.Rrtype == dns.TypeANY {
+					return dns.RcodeYXDomain
+				}
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			var key = name + "/" + dns.TypeToString[header.Rrtype]
+			expected[key] = append(expected[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, items := range expected {
+
+		var found = find(dns.CanonicalName(items[0].Header().Name), items[0].Header().Rrtype)
+
+		if len(found) != len(items) {
+			return dns.RcodeNXRrset
+		}
+
+	compare:
+		for _, item := range items {
+			for _, rr := range found {
+				if dns.IsDuplicate(item, rr) {
+					continue compare
+				}
+			}
+			return dns.RcodeNXRrset
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// toLibdnsRecord converts the dns record into a libdns record with the given (relative) name.
+func toLibdnsRecord(rr dns.RR, name string) libdns.Record {
+
+	var ttl = time.Duration(rr.Header().Ttl) * time.Second
+
+	switch x := rr.(type) {
+	case *dns.A:
+		if ip, ok := netip.AddrFromSlice(x.A); ok {
+			return libdns.Address{Name: name, TTL: ttl, IP: ip.Unmap()}
+		}
+	case *dns.AAAA:
+		if ip, ok := netip.AddrFromSlice(x.AAAA); ok {
+			return libdns.Address{Name: name, TTL: ttl, IP: ip}
+		}
+	case *dns.TXT:
+		return libdns.TXT{Name: name, TTL: ttl, Text: strings.Join(x.Txt, "")}
+	}
+
+	var record = libdns.RR{
+		Name: name,
+		TTL:  ttl,
+		Type: dns.TypeToString[rr.Header().Rrtype],
+		Data: strings.TrimPrefix(rr.String(), rr.Header().String()),
+	}
+
+	if parsed, err := record.Parse(); err == nil {
+		return parsed
+	}
+
+	return record
+}
+
+// toDNSRecord converts the libdns record into a dns record within the given zone.
+func toDNSRecord(record libdns.Record, zone string) (dns.RR, error) {
+
+	var rr = record.RR()
+	var data = rr.Data
+
+	if rr.Type == "TXT" {
+		data = `"` + strings.ReplaceAll(strings.ReplaceAll(data, `\`, `\\`), `"`, `\"`) + `"`
+	}
+
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", libdns.AbsoluteName(rr.Name, dns.CanonicalName(zone)), int(rr.TTL.Seconds()), rr.Type, data))
+}
+
+func (k *TSIGKey) allows(zone string) bool {
+
+	if len(k.Zones) == 0 {
+		return true
+	}
+
+	for _, item := range k.Zones {
+		if dns.CanonicalName(item) == dns.CanonicalName(zone) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnmarshalCaddyfile sets up the RFC 2136 server from Caddyfile tokens. Syntax:
+//
+//	rfc2136 {
+//		listen <address>...
+//		zones_ttl <duration>
+//		key <name> <secret> [<algorithm>] {
+//			zones <zone>...
+//		}
+//		providers {
+//			<name> ...
+//		}
+//	}
+func (s *RFC2136Server) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "listen":
+			var args = d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			s.Listen = append(s.Listen, args...)
+		case "zones_ttl":
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid zones ttl: %v", err)
+			}
+			s.ZonesTTL = caddy.Duration(ttl)
+		case "key":
+			var args = d.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			var key = &TSIGKey{Name: args[0], Secret: args[1]}
+			if len(args) == 3 {
+				key.Algorithm = args[2]
+			}
+			for sub := d.Nesting(); d.NextBlock(sub); {
+				switch d.Val() {
+				case "zones":
+					var zones = d.RemainingArgs()
+					if len(zones) == 0 {
+						return d.Errf("must specify at least one zone")
+					}
+					key.Zones = append(key.Zones, zones...)
+				default:
+					return d.Errf("unrecognized key option '%s'", d.Val())
+				}
+			}
+			s.Keys = append(s.Keys, key)
+		case "providers":
+			providers, err := unmarshalProviders(d)
+
+			if err != nil {
+				return err
+			}
+
+			s.ProvidersRaw = providers
+		default:
+			return d.Errf("unrecognized rfc2136 option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+var (
+	_ dns.Handler           = (*RFC2136Server)(nil)
+	_ caddyfile.Unmarshaler = (*RFC2136Server)(nil)
+)
@@ -0,0 +1,364 @@
+package dyndns_handler
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// memoryProvider is a Provider for a single zone that keeps the records in memory.
+type memoryProvider struct {
+	zone    string
+	records []libdns.RR
+	mu      sync.Mutex
+}
+
+func (*memoryProvider) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{ID: "dns.providers.memory"}
+}
+
+func (m *memoryProvider) ListZones(context.Context) ([]libdns.Zone, error) {
+	return []libdns.Zone{{Name: m.zone}}, nil
+}
+
+func (m *memoryProvider) GetRecords(context.Context, string) ([]libdns.Record, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var records = make([]libdns.Record, 0, len(m.records))
+
+	for _, record := range m.records {
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (m *memoryProvider) AppendRecords(_ context.Context, _ string, records []libdns.Record) ([]libdns.Record, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, record := range records {
+		m.records = append(m.records, record.RR())
+	}
+
+	return records, nil
+}
+
+func (m *memoryProvider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+
+	var sets = make([]libdns.Record, 0, len(records))
+
+	for _, record := range records {
+		sets = append(sets, libdns.RR{Name: record.RR().Name, Type: record.RR().Type})
+	}
+
+	if _, err := m.DeleteRecords(ctx, zone, sets); err != nil {
+		return nil, err
+	}
+
+	return m.AppendRecords(ctx, zone, records)
+}
+
+func (m *memoryProvider) DeleteRecords(_ context.Context, _ string, records []libdns.Record) ([]libdns.Record, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted = make([]libdns.Record, 0)
+
+	m.records = slices.DeleteFunc(m.records, func(existing libdns.RR) bool {
+		for _, record := range records {
+
+			var rr = record.RR()
+
+			if rr.Name == existing.Name && (rr.Type == "" || rr.Type == existing.Type) && (rr.TTL == 0 || rr.TTL == existing.TTL) && (rr.Data == "" || rr.Data == existing.Data) {
+				deleted = append(deleted, existing)
+				return true
+			}
+		}
+		return false
+	})
+
+	return deleted, nil
+}
+
+func (m *memoryProvider) count(name, kind string) int {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count = 0
+
+	for _, record := range m.records {
+		if record.Name == name && record.Type == kind {
+			count++
+		}
+	}
+
+	return count
+}
+
+const testSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ=" // secret-secret-secret
+
+// startRFC2136Server starts a server on a random local UDP port with the key
+// "update-key." and returns the address to send the updates to.
+func startRFC2136Server(t *testing.T, provider Provider) string {
+
+	var ctx, cancel = caddy.NewContext(caddy.Context{Context: context.Background()})
+	var logger = zap.NewNop()
+	var key = &TSIGKey{Name: "update-key.", Secret: testSecret, Algorithm: dns.HmacSHA256}
+	var server = &RFC2136Server{
+		Listen:    []string{"udp/127.0.0.1:0"},
+		Keys:      []*TSIGKey{key},
+		providers: []Provider{provider},
+		zones:     newZoneCache(ctx, []Provider{provider}, time.Minute, logger),
+		keys:      map[string]*TSIGKey{key.Name: key},
+		ctx:       ctx,
+		logger:    logger,
+	}
+
+	if err := server.start(); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		server.stop()
+		cancel()
+	})
+
+	for _, x := range server.servers {
+		if nil != x.PacketConn {
+			return x.PacketConn.LocalAddr().String()
+		}
+	}
+
+	t.Fatal("no udp server started")
+	return ""
+}
+
+// exchangeUpdate sends an update for example.com. with the update section
+// set by the given function, signed with the key when not empty.
+func exchangeUpdate(t *testing.T, address, key, secret string, update func(message *dns.Msg)) int {
+
+	var client = &dns.Client{Net: "udp", TsigSecret: map[string]string{key: secret}}
+	var message = new(dns.Msg)
+
+	message.SetUpdate("example.com.")
+	update(message)
+
+	if key != "" {
+		message.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	response, _, err := client.Exchange(message, address)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.Rcode
+}
+
+func mustRR(t *testing.T, value string) dns.RR {
+
+	rr, err := dns.NewRR(value)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
+
+func TestRFC2136Update(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com."}
+	var address = startRFC2136Server(t, provider)
+	var record = []dns.RR{mustRR(t, "host.example.com. 300 IN A 192.0.2.1")}
+
+	for i := 0; i < 2; i++ {
+		if rcode := exchangeUpdate(t, address, "update-key.", testSecret, func(message *dns.Msg) { message.Insert(record) }); rcode != dns.RcodeSuccess {
+			t.Fatalf("expected %s, got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[rcode])
+		}
+	}
+
+	if count := provider.count("host", "A"); count != 1 {
+		t.Fatalf("expected 1 A record after repeating the update, got %d", count)
+	}
+
+	if rcode := exchangeUpdate(t, address, "update-key.", testSecret, func(message *dns.Msg) { message.Remove(record) }); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected %s, got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[rcode])
+	}
+
+	if count := provider.count("host", "A"); count != 0 {
+		t.Fatalf("expected the A record to be deleted, got %d", count)
+	}
+}
+
+func TestRFC2136UpdateRefused(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com."}
+	var address = startRFC2136Server(t, provider)
+	var record = []dns.RR{mustRR(t, "host.example.com. 300 IN A 192.0.2.1")}
+
+	var tests = []struct {
+		name   string
+		key    string
+		secret string
+		rcode  int
+	}{
+		{"unsigned", "", "", dns.RcodeRefused},
+		{"unknown key", "other-key.", testSecret, dns.RcodeNotAuth},
+		{"wrong secret", "update-key.", "b3RoZXItc2VjcmV0", dns.RcodeNotAuth},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rcode := exchangeUpdate(t, address, test.key, test.secret, func(message *dns.Msg) { message.Insert(record) }); rcode != test.rcode {
+				t.Fatalf("expected %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+		})
+	}
+
+	if count := provider.count("host", "A"); count != 0 {
+		t.Fatalf("expected no records, got %d", count)
+	}
+}
+
+func TestRFC2136StartStop(t *testing.T) {
+
+	var ctx, cancel = caddy.NewContext(caddy.Context{Context: context.Background()})
+
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+
+		var server = &RFC2136Server{
+			Listen: []string{"127.0.0.1:0"},
+			keys:   map[string]*TSIGKey{},
+			ctx:    ctx,
+			logger: zap.NewNop(),
+		}
+
+		if err := server.start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// shutting down right after starting should not fail with "server not started"
+		for _, x := range server.servers {
+			if err := x.Shutdown(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRFC2136DeleteApex(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com.", records: []libdns.RR{
+		{Name: "@", Type: "SOA", Data: "ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"},
+		{Name: "@", Type: "NS", Data: "ns.example.com."},
+		{Name: "@", Type: "A", Data: "192.0.2.1"},
+		{Name: "@", Type: "TXT", Data: "v=spf1 -all"},
+		{Name: "host", Type: "A", Data: "192.0.2.2"},
+	}}
+
+	var address = startRFC2136Server(t, provider)
+	var apex = []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "example.com."}}}
+
+	if rcode := exchangeUpdate(t, address, "update-key.", testSecret, func(message *dns.Msg) { message.RemoveName(apex) }); rcode != dns.RcodeSuccess {
+		t.Fatalf("expected %s, got %s", dns.RcodeToString[dns.RcodeSuccess], dns.RcodeToString[rcode])
+	}
+
+	var tests = []struct {
+		name  string
+		kind  string
+		count int
+	}{
+		{"@", "SOA", 1},
+		{"@", "NS", 1},
+		{"@", "A", 0},
+		{"@", "TXT", 0},
+		{"host", "A", 1},
+	}
+
+	for _, test := range tests {
+		if count := provider.count(test.name, test.kind); count != test.count {
+			t.Fatalf("expected %d %s records for %s, got %d", test.count, test.kind, test.name, count)
+		}
+	}
+}
+
+func TestRFC2136UpdateFormErr(t *testing.T) {
+
+	var provider = &memoryProvider{zone: "example.com.", records: []libdns.RR{{Name: "host", Type: "A", Data: "192.0.2.1"}}}
+	var address = startRFC2136Server(t, provider)
+	var header = func(class uint16, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: "host.example.com.", Rrtype: rrtype, Class: class, Ttl: ttl}
+	}
+
+	var tests = []struct {
+		name string
+		rr   dns.RR
+	}{
+		{"delete rrset with ttl", &dns.ANY{Hdr: header(dns.ClassANY, dns.TypeA, 300)}},
+		{"delete rrset with data", &dns.A{Hdr: header(dns.ClassANY, dns.TypeA, 0), A: net.ParseIP("192.0.2.1")}},
+		{"delete rr with ttl", &dns.A{Hdr: header(dns.ClassNONE, dns.TypeA, 300), A: net.ParseIP("192.0.2.1")}},
+		{"delete rr of type any", &dns.ANY{Hdr: header(dns.ClassNONE, dns.TypeANY, 0)}},
+		{"add type any", &dns.ANY{Hdr: header(dns.ClassINET, dns.TypeANY, 300)}},
+		{"add type axfr", &dns.ANY{Hdr: header(dns.ClassINET, dns.TypeAXFR, 300)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rcode := exchangeUpdate(t, address, "update-key.", testSecret, func(message *dns.Msg) { message.Ns = append(message.Ns, test.rr) }); rcode != dns.RcodeFormatError {
+				t.Fatalf("expected %s, got %s", dns.RcodeToString[dns.RcodeFormatError], dns.RcodeToString[rcode])
+			}
+		})
+	}
+
+	if count := provider.count("host", "A"); count != 1 {
+		t.Fatalf("expected the A record to be kept, got %d", count)
+	}
+}
+
+func TestRFC2136StartFailure(t *testing.T) {
+
+	var ctx, cancel = caddy.NewContext(caddy.Context{Context: context.Background()})
+
+	defer cancel()
+
+	var server = func(listen ...string) *RFC2136Server {
+		return &RFC2136Server{Listen: listen, keys: map[string]*TSIGKey{}, ctx: ctx, logger: zap.NewNop()}
+	}
+
+	// the second address of the second server is invalid
+	var app = &App{RFC2136: []*RFC2136Server{server("127.0.0.1:0"), server("127.0.0.1:0", "udp/256.0.0.1:53")}}
+
+	if err := app.Start(); err == nil {
+		app.Stop()
+		t.Fatal("expected starting to fail")
+	}
+
+	for idx, server := range app.RFC2136 {
+		if len(server.servers) != 0 {
+			t.Fatalf("expected the servers of %d to be stopped, got %d", idx, len(server.servers))
+		}
+	}
+}
+
+var (
+	_ Provider = (*memoryProvider)(nil)
+)
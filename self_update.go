@@ -0,0 +1,261 @@
+package dyndns_handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// SelfUpdate periodically resolves the public addresses of the server and
+// updates the configured hostnames with them, so no separate ddns client
+// is needed for the server caddy runs on.
+type SelfUpdate struct {
+
+	// The hostnames that should point to this server
+	Hosts []string `json:"hosts,omitempty"`
+
+	// The provider configurations with which the records of
+	// the hostnames will be updated, where providers with the
+	// internal view (see OptionsProvider) are not updated.
+	ProvidersRaw []json.RawMessage `json:"providers,omitempty" caddy:"namespace=dns.providers inline_key=name"`
+
+	// How often the public addresses are resolved. Default: 5m
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// How the public addresses are resolved, when not
+	// set myip.opendns.com is resolved.
+	PublicIP *PublicIP `json:"public_ip,omitempty"`
+
+	// When true, the A records are not updated.
+	DisableIPv4 bool `json:"disable_ipv4,omitempty"`
+
+	// When true, the AAAA records are not updated.
+	DisableIPv6 bool `json:"disable_ipv6,omitempty"`
+
+	// The TTL of the records, per zone or hostname.
+	TTL *RecordTTL `json:"ttl,omitempty"`
+
+	// the updates are done by a handler that is not used for
+	// serving requests, so the change lists can be reused
+	updater *Handler
+	last    []netip.Addr
+	ctx     caddy.Context
+	cancel  context.CancelFunc
+	logger  *zap.Logger
+}
+
+func (s *SelfUpdate) provision(ctx caddy.Context, logger *zap.Logger) error {
+
+	if len(s.Hosts) == 0 {
+		return fmt.Errorf("no hosts defined")
+	}
+
+	if len(s.ProvidersRaw) == 0 {
+		return fmt.Errorf("no DNS providers defined")
+	}
+
+	if s.DisableIPv4 && s.DisableIPv6 {
+		return fmt.Errorf("both IPv4 and IPv6 are disabled")
+	}
+
+	if s.Interval <= 0 {
+		s.Interval = caddy.Duration(5 * time.Minute)
+	}
+
+	providers, err := loadProviders(ctx, s, "ProvidersRaw")
+
+	if err != nil {
+		return err
+	}
+
+	if nil != s.PublicIP {
+		if err := s.PublicIP.provision(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.updater = &Handler{
+		TTL:       s.TTL,
+		providers: providers,
+		zones:     newZoneCache(ctx, providers, 0, logger),
+		logger:    logger,
+	}
+
+	s.ctx = ctx
+	s.logger = logger
+
+	return nil
+}
+
+func (s *SelfUpdate) start() {
+
+	var ctx, cancel = context.WithCancel(s.ctx)
+
+	s.cancel = cancel
+
+	go func() {
+
+		var ticker = time.NewTicker(time.Duration(s.Interval))
+
+		defer ticker.Stop()
+
+		for {
+			s.update(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *SelfUpdate) stop() {
+	if nil != s.cancel {
+		s.cancel()
+	}
+}
+
+// resolve returns the public addresses of the server, where an address
+// that could not be resolved is logged and left out.
+func (s *SelfUpdate) resolve(ctx context.Context) []netip.Addr {
+
+	var ips = make([]netip.Addr, 0, 2)
+
+	for network, disabled := range map[string]bool{"ip4": s.DisableIPv4, "ip6": s.DisableIPv6} {
+
+		if disabled {
+			continue
+		}
+
+		ip, err := s.PublicIP.Resolve(ctx, network)
+
+		if err != nil {
+			s.logger.Warn("could not resolve public address", zap.String("network", network), zap.Error(err))
+			continue
+		}
+
+		ips = append(ips, ip)
+	}
+
+	slices.SortFunc(ips, func(a, b netip.Addr) int {
+		return a.Compare(b)
+	})
+
+	return ips
+}
+
+// update resolves the public addresses and updates the hostnames when
+// the addresses changed since the last successful update. The first
+// update compares against the current records, so nothing is written
+// on startup when the records are already up to date.
+func (s *SelfUpdate) update(ctx context.Context) {
+
+	var ips = s.resolve(ctx)
+
+	if len(ips) == 0 || slices.Equal(ips, s.last) {
+		return
+	}
+
+	var results = make([]ReturnCode, len(s.Hosts))
+
+	for idx := range results {
+		results[idx] = NoChange
+	}
+
+	// the resolved addresses are public, so internal providers are left out
+	var zones = s.updater.viewZones(s.updater.zones.Get(ctx), ViewPublic)
+	var updates = s.updater.makeChangeLists(s.Hosts, zones, &results, addressRecords(ips))
+
+	s.updater.applyChangeLists(ctx, updates, NewSemaphore(5), BaseProvider.SetRecords, true, Good, results)
+
+	var fields = make([]zap.Field, len(s.Hosts))
+	var failed = false
+
+	for idx, hostname := range s.Hosts {
+		fields[idx] = zap.String(hostname, string(results[idx]))
+		failed = failed || (results[idx] != Good && results[idx] != NoChange)
+	}
+
+	s.logger.Info("updated public addresses", append(fields, zap.Stringers("ips", ips))...)
+
+	// retry on the next interval when not all hosts succeeded
+	if false == failed {
+		s.last = ips
+	}
+}
+
+// UnmarshalCaddyfile sets up the self update from Caddyfile tokens. Syntax:
+//
+//	self_update {
+//		hosts <hostname>...
+//		interval <duration>
+//		disable_ipv4
+//		disable_ipv6
+//		public_ip {
+//			...
+//		}
+//		ttl [<duration>] {
+//			...
+//		}
+//		providers {
+//			<name> ...
+//		}
+//	}
+func (s *SelfUpdate) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "hosts":
+			var hosts = d.RemainingArgs()
+			if len(hosts) == 0 {
+				return d.Errf("must specify at least one host")
+			}
+			s.Hosts = append(s.Hosts, hosts...)
+		case "interval":
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid interval: %v", err)
+			}
+			s.Interval = caddy.Duration(interval)
+		case "disable_ipv4":
+			s.DisableIPv4 = true
+		case "disable_ipv6":
+			s.DisableIPv6 = true
+		case "public_ip":
+			s.PublicIP = new(PublicIP)
+			if err := s.PublicIP.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "ttl":
+			s.TTL = new(RecordTTL)
+			if err := s.TTL.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "providers":
+			providers, err := unmarshalProviders(d)
+
+			if err != nil {
+				return err
+			}
+
+			s.ProvidersRaw = providers
+		default:
+			return d.Errf("unrecognized self_update option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package dyndns_handler
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// RecordTTL configures the TTL of the created records, where the TTL
+// of a hostname overrides the TTL of the zone, which overrides the default.
+type RecordTTL struct {
+
+	// The TTL of the records. Default: 5m
+	Default caddy.Duration `json:"default,omitempty"`
+
+	// The TTL per zone
+	Zones map[string]caddy.Duration `json:"zones,omitempty"`
+
+	// The TTL per hostname or hostname pattern (like *.example.com)
+	Hosts map[string]caddy.Duration `json:"hosts,omitempty"`
+}
+
+// get returns the TTL for the hostname in the given zone, which can
+// be called on a nil config and will then return the defaultTTL.
+func (t *RecordTTL) get(hostname, zone string) time.Duration {
+
+	if nil == t {
+		return defaultTTL
+	}
+
+	if ttl, ok := t.host(hostname); ok {
+		return ttl
+	}
+
+	for name, ttl := range t.Zones {
+		if normalizeName(name) == normalizeName(zone) {
+			return time.Duration(ttl)
+		}
+	}
+
+	if t.Default > 0 {
+		return time.Duration(t.Default)
+	}
+
+	return defaultTTL
+}
+
+// host returns the TTL of the most specific matching hostname pattern,
+// which is the one with the least wildcards.
+func (t *RecordTTL) host(hostname string) (time.Duration, bool) {
+
+	var patterns = make([]string, 0)
+
+	for pattern := range t.Hosts {
+		if matchHostname(pattern, hostname) {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	if len(patterns) == 0 {
+		return 0, false
+	}
+
+	sort.Slice(patterns, func(i, j int) bool {
+		if x, y := strings.Count(patterns[i], "*"), strings.Count(patterns[j], "*"); x != y {
+			return x < y
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	return time.Duration(t.Hosts[patterns[0]]), true
+}
+
+// UnmarshalCaddyfile sets up the TTL config from Caddyfile tokens. Syntax:
+//
+//	ttl [<duration>] {
+//		zone <zone> <duration>
+//		host <hostname|pattern> <duration>
+//	}
+func (t *RecordTTL) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+
+	var parse = func(value string) (caddy.Duration, error) {
+
+		ttl, err := caddy.ParseDuration(value)
+
+		if err != nil {
+			return 0, d.Errf("invalid ttl: %v", err)
+		}
+
+		if ttl < time.Second {
+			return 0, d.Errf("invalid ttl: %s is less than a second", value)
+		}
+
+		return caddy.Duration(ttl), nil
+	}
+
+	if d.NextArg() {
+
+		ttl, err := parse(d.Val())
+
+		if err != nil {
+			return err
+		}
+
+		t.Default = ttl
+
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "zone", "host":
+			var kind, name, value = d.Val(), "", ""
+			if !d.AllArgs(&name, &value) {
+				return d.ArgErr()
+			}
+			ttl, err := parse(value)
+			if err != nil {
+				return err
+			}
+			if kind == "zone" {
+				if nil == t.Zones {
+					t.Zones = make(map[string]caddy.Duration)
+				}
+				t.Zones[name] = ttl
+			} else {
+				if nil == t.Hosts {
+					t.Hosts = make(map[string]caddy.Duration)
+				}
+				t.Hosts[name] = ttl
+			}
+		default:
+			return d.Errf("unrecognized ttl option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
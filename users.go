@@ -0,0 +1,281 @@
+package dyndns_handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"go.uber.org/zap"
+)
+
+// User holds the credentials and permissions of a single user.
+type User struct {
+
+	// The password used for basic authentication. When the handler
+	// has a hash algorithm configured, this should be the hashed
+	// password as generated by `caddy hash-password`.
+	Password string `json:"password,omitempty"`
+
+	// List of hostnames the user is allowed to update. An entry
+	// can be an exact hostname or a wildcard pattern like
+	// *.home.example.com, where the wildcard matches exactly
+	// one label. When empty, all hostnames are allowed.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Token which can be used instead of the username and
+	// password, see Handler.TokenParam and Handler.TokenHeader
+	Token string `json:"token,omitempty"`
+
+	// List of the optional update parameters (wildcard, mx, backmx,
+	// offline, txt, myipv6prefix and mylanip) the user is allowed to use.
+	// When not set, all parameters are allowed and an empty list allows none.
+	Parameters []string `json:"parameters,omitzero"`
+
+	// Restricts the addresses the user can update hostnames with,
+	// on top of the ip policies of the handler.
+	IPPolicy *IPPolicy `json:"ip_policy,omitempty"`
+
+	// the decoded hash, or the sha256 sum of
+	// the plain password, used for comparing
+	password []byte
+	token    []byte
+}
+
+// UnmarshalJSON also accepts a plain string as password so
+// configs using the old username – password map keep working.
+func (u *User) UnmarshalJSON(data []byte) error {
+	var passwd string
+
+	if err := json.Unmarshal(data, &passwd); err == nil {
+		*u = User{Password: passwd}
+		return nil
+	}
+
+	type plain User
+
+	return json.Unmarshal(data, (*plain)(u))
+}
+
+// Allows checks if the user is permitted to update the given hostname.
+func (u *User) Allows(hostname string) bool {
+
+	if nil == u || len(u.Hosts) == 0 {
+		return true
+	}
+
+	for _, pattern := range u.Hosts {
+		if matchHostname(pattern, hostname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsParameter checks if the user is permitted to use the given
+// optional update parameter, like wildcard or mx.
+func (u *User) AllowsParameter(name string) bool {
+
+	if nil == u || nil == u.Parameters {
+		return true
+	}
+
+	for _, value := range u.Parameters {
+		if strings.EqualFold(value, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseParameters returns the list for User.Parameters, where the value
+// "none" is left out, so it can be used to allow no parameters at all.
+func parseParameters(values []string) []string {
+
+	var parameters = make([]string, 0, len(values))
+
+	for _, value := range values {
+		if false == strings.EqualFold(value, "none") {
+			parameters = append(parameters, value)
+		}
+	}
+
+	return parameters
+}
+
+// matchHostname does a case-insensitive compare of the hostname
+// against the pattern, where a "*" label in the pattern matches
+// any single label of the hostname.
+func matchHostname(pattern, hostname string) bool {
+
+	var patterns = strings.Split(strings.ToLower(strings.TrimSuffix(pattern, ".")), ".")
+	var labels = strings.Split(strings.ToLower(strings.TrimSuffix(hostname, ".")), ".")
+
+	if len(patterns) != len(labels) {
+		return false
+	}
+
+	for i, c := 0, len(patterns); i < c; i++ {
+		if patterns[i] != "*" && patterns[i] != labels[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// provisionUsers loads the configured hash module and prepares
+// the passwords of all users for comparing.
+func (h *Handler) provisionUsers(ctx caddy.Context) error {
+
+	h.fakePassword = make([]byte, sha256.Size)
+
+	if nil != h.HashRaw {
+
+		val, err := ctx.LoadModule(h, "HashRaw")
+
+		if err != nil {
+			return fmt.Errorf("loading password hasher module: %v", err)
+		}
+
+		h.hash = val.(caddyauth.Comparer)
+
+		if hasher, ok := h.hash.(caddyauth.Hasher); ok {
+			h.fakePassword = hasher.FakeHash()
+		}
+	}
+
+	for name, user := range h.Users {
+		if err := user.provision(h.hash != nil); err != nil {
+			return fmt.Errorf("user %s: %v", name, err)
+		}
+	}
+
+	return checkDuplicateTokens(h.Users)
+}
+
+// checkDuplicateTokens makes sure no token is shared by multiple users
+// of the given sets, as a token identifies the user and would otherwise
+// match the first user found.
+func checkDuplicateTokens(sets ...map[string]*User) error {
+
+	var tokens = make(map[string]string)
+
+	for _, users := range sets {
+		for _, name := range slices.Sorted(maps.Keys(users)) {
+
+			var user = users[name]
+
+			if user.Token == "" {
+				continue
+			}
+
+			if other, x := tokens[user.Token]; x {
+				return fmt.Errorf("users %s and %s have the same token", other, name)
+			}
+
+			tokens[user.Token] = name
+		}
+	}
+
+	return nil
+}
+
+func (u *User) provision(hashed bool) error {
+
+	if u.Token != "" {
+		var sum = sha256.Sum256([]byte(u.Token))
+		u.token = sum[:]
+	}
+
+	if u.Password == "" {
+		u.password = nil
+		return nil
+	}
+
+	if false == hashed {
+		var sum = sha256.Sum256([]byte(u.Password))
+		u.password = sum[:]
+		return nil
+	}
+
+	// same as basic_auth, hashes in the modular crypt format
+	// are used as is and others are expected to be base64 encoded
+	if strings.HasPrefix(u.Password, "$") {
+		u.password = []byte(u.Password)
+		return nil
+	}
+
+	value, err := base64.StdEncoding.DecodeString(u.Password)
+
+	if err != nil {
+		return fmt.Errorf("base64-decoding password: %v", err)
+	}
+
+	u.password = value
+
+	return nil
+}
+
+// checkPassword compares the given password in constant time against
+// the password of the user. When the user does not exist, a fake
+// password is compared, so the timing does not reveal if it exists.
+func (h *Handler) checkPassword(user *User, passwd string) bool {
+
+	var exists = nil != user && len(user.password) > 0
+	var expected = h.fakePassword
+
+	if exists {
+		expected = user.password
+	}
+
+	if nil == h.hash {
+		var sum = sha256.Sum256([]byte(passwd))
+		return subtle.ConstantTimeCompare(sum[:], expected) == 1 && exists
+	}
+
+	same, err := h.hash.Compare(expected, []byte(passwd))
+
+	if err != nil {
+		h.logger.Error("comparing password failed", zap.Error(err))
+		return false
+	}
+
+	return same && exists
+}
+
+// checkToken compares the given token against the tokens of all
+// users and returns the name of the matching user. All users are
+// compared, so the timing does not reveal which user matched.
+func (h *Handler) checkToken(token string) (string, *User, bool) {
+
+	var sum = sha256.Sum256([]byte(token))
+	var name string
+	var found *User
+
+	var compare = func(users map[string]*User) {
+		for key, user := range users {
+			if len(user.token) > 0 && subtle.ConstantTimeCompare(sum[:], user.token) == 1 && nil == found {
+				name, found = key, user
+			}
+		}
+	}
+
+	// users from the config are compared first as
+	// they take precedence over the users file
+	compare(h.Users)
+
+	if users := h.fileUsers.Load(); users != nil {
+		compare(*users)
+	}
+
+	return name, found, nil != found
+}
@@ -0,0 +1,216 @@
+package dyndns_handler
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// loadUsersFile reads the users from the given file, which can be
+// a htpasswd-style file where every line is formatted as
+//
+//	username:password[:host,host...[:token[:parameter,parameter...]]]
+//
+// or, when the file has a .csv extension, a CSV file with the columns
+// username, password, hosts (separated by spaces), token and parameters
+// (separated by spaces). An empty parameters field allows all parameters
+// and "none" allows no parameters (see User.Parameters). Empty lines and
+// lines starting with a # are ignored.
+func loadUsersFile(file string, hashed bool) (map[string]*User, error) {
+
+	fd, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	var records [][]string
+
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		records, err = readUsersCSV(fd)
+	} else {
+		records, err = readUsersPasswd(fd)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var users = make(map[string]*User)
+
+	for idx, record := range records {
+
+		if len(record) < 2 || len(record) > 5 || record[0] == "" {
+			return nil, fmt.Errorf("%s: record %d: expected a username, password, hosts, token and parameters", file, idx+1)
+		}
+
+		if _, x := users[record[0]]; x {
+			return nil, fmt.Errorf("%s: duplicate user %s", file, record[0])
+		}
+
+		var user = &User{Password: record[1]}
+		var fields = func(value string) []string {
+			return strings.FieldsFunc(value, func(r rune) bool {
+				return r == ',' || r == ' '
+			})
+		}
+
+		if len(record) > 2 {
+			user.Hosts = fields(record[2])
+		}
+
+		if len(record) > 3 {
+			user.Token = record[3]
+		}
+
+		if len(record) > 4 && strings.TrimSpace(record[4]) != "" {
+			user.Parameters = parseParameters(fields(record[4]))
+		}
+
+		if err := user.provision(hashed); err != nil {
+			return nil, fmt.Errorf("%s: user %s: %v", file, record[0], err)
+		}
+
+		users[record[0]] = user
+	}
+
+	return users, nil
+}
+
+// readUsersFile loads the users file and checks that the tokens are not
+// shared with other users of the file or the users of the config.
+func (h *Handler) readUsersFile() (map[string]*User, error) {
+
+	users, err := loadUsersFile(h.UsersFile, h.hash != nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDuplicateTokens(h.Users, users); err != nil {
+		return nil, fmt.Errorf("%s: %v", h.UsersFile, err)
+	}
+
+	return users, nil
+}
+
+func readUsersPasswd(reader io.Reader) ([][]string, error) {
+
+	var scanner = bufio.NewScanner(reader)
+	var records = make([][]string, 0)
+
+	for scanner.Scan() {
+
+		var line = strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		records = append(records, strings.SplitN(line, ":", 5))
+	}
+
+	return records, scanner.Err()
+}
+
+func readUsersCSV(reader io.Reader) ([][]string, error) {
+
+	var csvReader = csv.NewReader(reader)
+
+	csvReader.Comment = '#'
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	return csvReader.ReadAll()
+}
+
+// provisionUsersFile loads the users file and starts watching it
+// for changes, so users can be updated without a config reload.
+func (h *Handler) provisionUsersFile(ctx caddy.Context) error {
+
+	h.fileUsers = new(atomic.Pointer[map[string]*User])
+
+	if h.UsersFile == "" {
+		return nil
+	}
+
+	info, err := os.Stat(h.UsersFile)
+
+	if err != nil {
+		return fmt.Errorf("loading users file: %v", err)
+	}
+
+	users, err := h.readUsersFile()
+
+	if err != nil {
+		return fmt.Errorf("loading users file: %v", err)
+	}
+
+	h.fileUsers.Store(&users)
+
+	var interval = time.Duration(h.UsersFileInterval)
+
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	go h.watchUsersFile(ctx, info, interval)
+
+	return nil
+}
+
+// watchUsersFile polls the users file and reloads it when the modification
+// time or size changed. When loading fails, the previous users are kept.
+func (h *Handler) watchUsersFile(ctx caddy.Context, last os.FileInfo, interval time.Duration) {
+
+	var ticker = time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+
+			info, err := os.Stat(h.UsersFile)
+
+			if err != nil {
+				if false == errors.Is(err, os.ErrNotExist) || last != nil {
+					h.logger.Error("could not stat users file", zap.String("file", h.UsersFile), zap.Error(err))
+				}
+				last = nil
+				continue
+			}
+
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+
+			last = info
+
+			users, err := h.readUsersFile()
+
+			if err != nil {
+				h.logger.Error("could not reload users file, keeping previous users", zap.Error(err))
+				continue
+			}
+
+			h.fileUsers.Store(&users)
+
+			h.logger.Info("reloaded users file", zap.String("file", h.UsersFile), zap.Int("users", len(users)))
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package dyndns_handler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// writeUsersFile writes the content to the file in the
+// temporary directory of the test and returns the path.
+func writeUsersFile(t *testing.T, name, content string) string {
+
+	var file = filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestLoadUsersFile(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		content string
+	}{
+		{"users.htpasswd", "# comment\n\nfoo:bar\nbaz:qux:a.example.com,*.home.example.com:secret:mx,offline\nnone:pass::: none\n"},
+		{"users.csv", "# comment\nfoo,bar\nbaz,qux,a.example.com *.home.example.com,secret,mx offline\nnone,pass,,,none\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			users, err := loadUsersFile(writeUsersFile(t, test.name, test.content), false)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(users) != 3 {
+				t.Fatalf("expected 3 users, got %d", len(users))
+			}
+
+			if user := users["foo"]; user.Password != "bar" || nil != user.Hosts || user.Token != "" || nil != user.Parameters {
+				t.Fatalf("unexpected user foo: %+v", user)
+			}
+
+			if user := users["baz"]; user.Password != "qux" || false == slices.Equal(user.Hosts, []string{"a.example.com", "*.home.example.com"}) || user.Token != "secret" || false == slices.Equal(user.Parameters, []string{"mx", "offline"}) {
+				t.Fatalf("unexpected user baz: %+v", user)
+			}
+
+			if user := users["none"]; nil == user.Parameters || len(user.Parameters) != 0 {
+				t.Fatalf("expected no parameters to be allowed for user none, got %v", user.Parameters)
+			}
+		})
+	}
+}
+
+func TestLoadUsersFileInvalid(t *testing.T) {
+
+	var tests = []struct {
+		name    string
+		content string
+		config  map[string]*User
+	}{
+		{"users.htpasswd", "foo\n", nil},
+		{"users.htpasswd", ":bar\n", nil},
+		{"users.htpasswd", "foo:bar\nfoo:baz\n", nil},
+		{"users.htpasswd", "foo:bar::secret\nbaz:qux::secret\n", nil},
+		{"users.htpasswd", "foo:bar::secret\n", map[string]*User{"baz": {Token: "secret"}}},
+		{"users.csv", "foo,bar,,,,extra\n", nil},
+		{"users.csv", "foo,\"bar\n", nil},
+	}
+
+	for _, test := range tests {
+
+		var handler = &Handler{Users: test.config, UsersFile: writeUsersFile(t, test.name, test.content)}
+
+		if _, err := handler.readUsersFile(); err == nil {
+			t.Fatalf("expected an error for %q", test.content)
+		}
+	}
+}
+
+func TestWatchUsersFile(t *testing.T) {
+
+	var ctx, cancel = caddy.NewContext(caddy.Context{Context: context.Background()})
+	var handler = newTestHandler(t, nil)
+
+	t.Cleanup(cancel)
+
+	handler.UsersFile = writeUsersFile(t, "users.htpasswd", "foo:bar\n")
+	handler.UsersFileInterval = caddy.Duration(10 * time.Millisecond)
+
+	if err := handler.provisionUsersFile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(handler.UsersFile, []byte("foo:bar\nfoo:baz\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the invalid file is never loaded, so wait for a few reloads
+	time.Sleep(100 * time.Millisecond)
+
+	if nil == handler.lookupUser("foo") {
+		t.Fatal("expected the previous users to be kept")
+	}
+
+	if err := os.WriteFile(handler.UsersFile, []byte("baz:qux\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(time.Second); nil == handler.lookupUser("baz"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the users file to be reloaded")
+		}
+	}
+
+	if nil != handler.lookupUser("foo") {
+		t.Fatal("expected the users of the previous file to be removed")
+	}
+}
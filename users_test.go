@@ -0,0 +1,166 @@
+package dyndns_handler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+// bcrypt hash (cost 4) of the password "bar", which is also
+// given base64 encoded as basic_auth accepts both
+const testBcryptHash = "$2a$04$rR.Ddn.sVr8hfi4R6gOgiOFmCKv.oxwkyasIAdITf56nRwp1abpte"
+
+// acceptingComparer accepts every password and
+// keeps the hashes it was asked to compare.
+type acceptingComparer struct {
+	hashes [][]byte
+}
+
+func (a *acceptingComparer) Compare(hashed, _ []byte) (bool, error) {
+	a.hashes = append(a.hashes, hashed)
+	return true, nil
+}
+
+func TestMatchHostname(t *testing.T) {
+
+	var tests = []struct {
+		pattern  string
+		hostname string
+		match    bool
+	}{
+		{"home.example.com", "home.example.com", true},
+		{"home.example.com", "other.example.com", false},
+		{"home.example.com", "HOME.Example.com.", true},
+		{"Home.Example.COM.", "home.example.com", true},
+		{"*.home.example.com", "nas.home.example.com", true},
+		{"*.home.example.com", "home.example.com", false},
+		{"*.home.example.com", "a.nas.home.example.com", false},
+		{"nas.*.example.com", "nas.home.example.com", true},
+		{"*", "com", true},
+		{"*", "example.com", false},
+	}
+
+	for _, test := range tests {
+		if match := matchHostname(test.pattern, test.hostname); match != test.match {
+			t.Fatalf("expected %t for %s against %s, got %t", test.match, test.hostname, test.pattern, match)
+		}
+	}
+}
+
+func TestUserAllows(t *testing.T) {
+
+	var user = &User{Hosts: []string{"home.example.com", "*.home.example.com"}}
+
+	var tests = []struct {
+		user     *User
+		hostname string
+		allowed  bool
+	}{
+		{user, "home.example.com", true},
+		{user, "nas.home.example.com", true},
+		{user, "example.com", false},
+		{user, "a.nas.home.example.com", false},
+		{&User{}, "example.com", true},
+		{nil, "example.com", true},
+	}
+
+	for _, test := range tests {
+		if allowed := test.user.Allows(test.hostname); allowed != test.allowed {
+			t.Fatalf("expected %t for %s, got %t", test.allowed, test.hostname, allowed)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+
+	var plain = newTestHandler(t, map[string]*User{"foo": {Password: "bar"}, "nopass": {}})
+	var hashed = newTestHandler(t, nil)
+
+	hashed.hash = caddyauth.BcryptHash{}
+	hashed.fakePassword = caddyauth.BcryptHash{}.FakeHash()
+	hashed.Users = map[string]*User{"foo": {Password: testBcryptHash}, "base64": {Password: "JDJhJDA0JHJSLkRkbi5zVnI4aGZpNFI2Z09naU9GbUNLdi5veHdreWFzSUFkSVRmNTZuUndwMWFicHRl"}}
+
+	for _, user := range hashed.Users {
+		if err := user.provision(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		handler *Handler
+		user    string
+		passwd  string
+		allowed bool
+	}{
+		{"plain", plain, "foo", "bar", true},
+		{"plain wrong password", plain, "foo", "baz", false},
+		{"plain without password", plain, "nopass", "", false},
+		{"plain unknown user", plain, "unknown", "", false},
+		{"hashed", hashed, "foo", "bar", true},
+		{"hashed wrong password", hashed, "foo", "baz", false},
+		{"hashed base64", hashed, "base64", "bar", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := test.handler.checkPassword(test.handler.lookupUser(test.user), test.passwd); allowed != test.allowed {
+				t.Fatalf("expected %t for %s, got %t", test.allowed, test.user, allowed)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordUnknownUser(t *testing.T) {
+
+	var comparer = new(acceptingComparer)
+	var handler = newTestHandler(t, nil)
+
+	handler.hash = comparer
+	handler.fakePassword = caddyauth.BcryptHash{}.FakeHash()
+
+	// the fake hash is compared, so the timing is the same as for existing
+	// users, but it should not be accepted even when the compare succeeds
+	if handler.checkPassword(nil, "antitiming") {
+		t.Fatal("expected an unknown user to be rejected")
+	}
+
+	if len(comparer.hashes) != 1 || false == bytes.Equal(comparer.hashes[0], handler.fakePassword) {
+		t.Fatalf("expected the fake hash to be compared, got %q", comparer.hashes)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+
+	var handler = newTestHandler(t, map[string]*User{"foo": {Token: "secret"}, "bar": {Token: "other"}})
+	var file = map[string]*User{"baz": {Token: "secret"}, "qux": {Token: "file"}}
+
+	for _, user := range file {
+		if err := user.provision(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler.fileUsers.Store(&file)
+
+	var tests = []struct {
+		token string
+		name  string
+	}{
+		{"secret", "foo"},
+		{"other", "bar"},
+		{"file", "qux"},
+		{"unknown", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+
+		name, user, ok := handler.checkToken(test.token)
+
+		if name != test.name || ok != (test.name != "") || (nil == user) == ok {
+			t.Fatalf("expected user %q for token %q, got %q", test.name, test.token, name)
+		}
+	}
+}